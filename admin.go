@@ -0,0 +1,208 @@
+package main
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ListAuditEntries godoc
+// @Summary List audit log entries
+// @Tags admin
+// @x-v1 true
+// @x-v2 true
+// @Description Returns the newest audit entries first. Requires an admin JWT.
+// @Produce json
+// @Param event query string false "Event type, e.g. login.failure"
+// @Param login query string false "Player the event is about"
+// @Param actor query string false "Player who caused the event"
+// @Param since query string false "RFC3339 lower bound (inclusive)"
+// @Param until query string false "RFC3339 upper bound (exclusive)"
+// @Param limit query int false "Maximum number of entries (default 100, max 1000)"
+// @Success 200 {array} AuditEntry
+// @Failure 400 {object} Problem "Invalid filter"
+// @Failure 401 {object} Problem "Unauthorized or missing token"
+// @Failure 403 {object} Problem "Admin access required"
+// @Failure 500 {object} Problem "Internal server error"
+// @Failure 503 {object} Problem "Database is unavailable"
+// @Router /admin/audit [get]
+func ListAuditEntries(c *gin.Context) {
+	filter := AuditFilter{
+		Event: c.Query("event"),
+		Login: c.Query("login"),
+		Actor: c.Query("actor"),
+		Limit: 100,
+	}
+
+	var err error
+
+	if since := c.Query("since"); since != "" {
+		if filter.Since, err = time.Parse(time.RFC3339, since); err != nil {
+			respondError(c, invalidParam("since", "rfc3339", nil))
+			return
+		}
+	}
+
+	if until := c.Query("until"); until != "" {
+		if filter.Until, err = time.Parse(time.RFC3339, until); err != nil {
+			respondError(c, invalidParam("until", "rfc3339", nil))
+			return
+		}
+	}
+
+	if limit := c.Query("limit"); limit != "" {
+		filter.Limit, err = strconv.Atoi(limit)
+		if err != nil || filter.Limit < 1 || filter.Limit > 1000 {
+			respondError(c, invalidParam("limit", "range", map[string]string{"min": "1", "max": "1000"}))
+			return
+		}
+	}
+
+	entries, err := GetAuditEntries(c.Request.Context(), filter)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, entries)
+}
+
+// UnlockPlayer godoc
+// @Summary Unlock a player after too many failed logins
+// @Tags admin
+// @x-v1 true
+// @x-v2 true
+// @Description Clears the failed login counter and lockout of the player. Requires an admin JWT.
+// @Produce json
+// @Param login path string true "Login"
+// @Success 200 {object} map[string]string "Unlocked"
+// @Failure 401 {object} Problem "Unauthorized or missing token"
+// @Failure 403 {object} Problem "Admin access required"
+// @Failure 500 {object} Problem "Internal server error"
+// @Failure 503 {object} Problem "Database is unavailable"
+// @Router /admin/players/{login}/unlock [post]
+func UnlockPlayer(c *gin.Context) {
+	login := c.Param("login")
+
+	if err := ResetLoginAttempts(loginKey(c.Request.Context(), login)); err != nil {
+		respondError(c, err)
+		return
+	}
+
+	audit(c, AuditAdminUnlock, login, "")
+
+	c.IndentedJSON(http.StatusOK, gin.H{"message": message(c, "unlocked")})
+}
+
+type PasswordResetRequest struct {
+	NewPassword string `json:"new_password" binding:"required"`
+}
+
+// ResetPassword godoc
+// @Summary Force a new password for a player
+// @Tags admin
+// @x-v1 true
+// @x-v2 true
+// @Description Sets the password without the old one and revokes every session of the player. Requires an admin JWT.
+// @Accept json
+// @Produce json
+// @Param login path string true "Login"
+// @Param body body PasswordResetRequest true "New SHA256 password hash"
+// @Success 200 {object} map[string]string "Password reset"
+// @Failure 400 {object} Problem "Invalid input or no such player"
+// @Failure 401 {object} Problem "Unauthorized or missing token"
+// @Failure 403 {object} Problem "Admin access required"
+// @Failure 500 {object} Problem "Internal server error"
+// @Failure 503 {object} Problem "Database is unavailable"
+// @Router /admin/players/{login}/password [put]
+func ResetPassword(c *gin.Context) {
+	login := c.Param("login")
+
+	var json PasswordResetRequest
+
+	if err := c.ShouldBindJSON(&json); err != nil {
+		respondError(c, bindingError(err))
+		return
+	}
+
+	if !IsValidSHA256Hash(json.NewPassword) {
+		respondError(c, ErrUnhashedPassword)
+		return
+	}
+
+	if err := ResetPlayerPassword(c.Request.Context(), login, json.NewPassword); err != nil {
+		respondError(c, err)
+		return
+	}
+
+	audit(c, AuditAdminPasswordReset, login, "")
+
+	c.IndentedJSON(http.StatusOK, gin.H{"message": message(c, "password_reset")})
+}
+
+// UploadRoster godoc
+// @Summary Upload the course roster
+// @Tags admin
+// @x-v1 true
+// @x-v2 true
+// @Description Replaces the course users with the uploaded roster when users.directory is roster. CSV needs a header row naming username, name and optionally tg_id, JSON is an array of entries. The file can also be sent as the request body with a text/csv or application/json content type. Students missing from the roster are removed, and deactivated if so configured. Requires an admin JWT.
+// @Accept multipart/form-data
+// @Produce json
+// @Param file formData file true "Roster as .csv or .json"
+// @Success 200 {object} RosterChanges
+// @Failure 400 {object} Problem "Invalid or empty roster"
+// @Failure 401 {object} Problem "Unauthorized or missing token"
+// @Failure 403 {object} Problem "Admin access required"
+// @Failure 409 {object} Problem "Users do not come from an uploaded roster"
+// @Failure 500 {object} Problem "Internal server error"
+// @Failure 503 {object} Problem "Database is unavailable"
+// @Router /admin/roster [post]
+func UploadRoster(c *gin.Context) {
+	if courseFrom(c.Request.Context()).directory() != "roster" {
+		respondError(c, ErrRosterImportDisabled)
+		return
+	}
+
+	users, err := rosterUpload(c)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	changes, err := ImportRoster(c.Request.Context(), users, rosterDeactivateRemoved, c.MustGet("claims").(*JWTClaims).Login)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	audit(c, AuditAdminRosterImport, "", fmt.Sprintf("%d entries: added %d, renamed %d, removed %d, restored %d",
+		len(users), changes.Added, changes.Renamed, changes.Removed, changes.Restored))
+
+	c.IndentedJSON(http.StatusOK, changes)
+}
+
+// rosterUpload parses a roster sent as the multipart file field or as the request body
+func rosterUpload(c *gin.Context) ([]User, error) {
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxRosterSize)
+
+	var body io.Reader = c.Request.Body
+	format := rosterFormat(c.ContentType(), "")
+	if strings.HasPrefix(c.ContentType(), "multipart/") {
+		header, err := c.FormFile("file")
+		if err != nil {
+			return nil, invalidParam("file", "required", nil)
+		}
+		file, err := header.Open()
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		body, format = file, rosterFormat(header.Header.Get("Content-Type"), header.Filename)
+	}
+
+	return ParseRoster(body, format)
+}
@@ -7,41 +7,72 @@ import (
 	"github.com/gin-gonic/gin"
 	swaggerfiles "github.com/swaggo/files"
 	ginSwagger "github.com/swaggo/gin-swagger"
+	"gorm.io/gorm"
+	"log"
+	"log/slog"
+	"math"
 	_ "memoryGameAPI/docs"
+	docsv1 "memoryGameAPI/docs/v1"
+	docsv2 "memoryGameAPI/docs/v2"
 	"net/http"
-	"os"
 	"strconv"
-	"strings"
 	"time"
 )
 
 // ListUsers godoc
-// @Summary List all users
+// @Summary List users
 // @Tags users
+// @x-v1 true
+// @Description Returns one page of course users. The total number of matches is in X-Total-Count,
+// @Description the next page is linked in the Link header.
 // @Accept  json
 // @Produce  json
+// @Param limit query int false "Page size (default 50, max 500)"
+// @Param after query string false "Cursor from the Link header of the previous page"
+// @Param sort query string false "username or name, prefix with - for descending order" default(username)
+// @Param username query string false "Username prefix"
 // @Success 200 {array} User
+// @Header 200 {integer} X-Total-Count "Number of matching users"
+// @Header 200 {string} Link "Next page"
+// @Failure 400 {object} Problem
+// @Failure 500 {object} Problem
+// @Failure 503 {object} Problem "Database is unavailable"
 // @Router /users [get]
 func ListUsers(c *gin.Context) {
-	users := GetAllUsers()
+	page, err := parsePage(c, userSorts, "username")
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	users, total, next, err := Users.FindUsers(c.Request.Context(), UserFilter{UsernamePrefix: c.Query("username")}, page)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	setPageHeaders(c, total, next)
 	c.IndentedJSON(http.StatusOK, users)
 }
 
 // GetUser godoc
 // @Summary Get a user by username
 // @Tags users
+// @x-v1 true
 // @Accept  json
 // @Produce  json
 // @Param username path string true "Username"
 // @Success 200 {object} User
-// @Failure 404 {object} map[string]string
+// @Failure 404 {object} Problem
+// @Failure 500 {object} Problem
+// @Failure 503 {object} Problem "Database is unavailable"
 // @Router /users/{username} [get]
 func GetUser(c *gin.Context) {
 	username := c.Param("username")
 
-	user, err := GetUserByUsername(username)
+	user, err := Users.GetUser(c.Request.Context(), username)
 	if err != nil {
-		c.IndentedJSON(http.StatusNotFound, gin.H{"error": "user not found"})
+		respondError(c, err)
 		return
 	}
 
@@ -49,32 +80,82 @@ func GetUser(c *gin.Context) {
 }
 
 // ListPlayers godoc
-// @Summary List all players
+// @Summary List players
 // @Tags players
+// @x-v1 true
+// @Description Returns one page of players. The total number of matches is in X-Total-Count,
+// @Description the next page is linked in the Link header.
 // @Accept  json
 // @Produce  json
+// @Param limit query int false "Page size (default 50, max 500)"
+// @Param after query string false "Cursor from the Link header of the previous page"
+// @Param sort query string false "score, login or created, prefix with - for descending order" default(-score)
+// @Param min_score query int false "Only players with at least this score"
+// @Param login query string false "Login prefix"
+// @Param group query string false "Only members of the group with this slug, a per-group leaderboard"
 // @Success 200 {array} Player
+// @Header 200 {integer} X-Total-Count "Number of matching players"
+// @Header 200 {string} Link "Next page"
+// @Failure 400 {object} Problem
+// @Failure 404 {object} Problem "No such group"
+// @Failure 500 {object} Problem
+// @Failure 503 {object} Problem "Database is unavailable"
 // @Router /players [get]
 func ListPlayers(c *gin.Context) {
-	players := GetAllPlayers()
+	page, err := parsePage(c, playerSorts, "-score")
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	filter, err := playerFilterFromQuery(c)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	players, total, next, err := FindPlayers(c.Request.Context(), filter, page)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	setPageHeaders(c, total, next)
 	c.IndentedJSON(http.StatusOK, players)
 }
 
+func playerFilterFromQuery(c *gin.Context) (PlayerFilter, error) {
+	filter := PlayerFilter{LoginPrefix: c.Query("login"), Group: c.Query("group")}
+
+	if minScore := c.Query("min_score"); minScore != "" {
+		score, err := strconv.ParseUint(minScore, 10, 0)
+		if err != nil {
+			return PlayerFilter{}, invalidParam("min_score", "uint", nil)
+		}
+		filter.MinScore = uint(score)
+	}
+
+	return filter, nil
+}
+
 // GetPlayer godoc
 // @Summary Get a player by login
 // @Tags players
+// @x-v1 true
 // @Accept  json
 // @Produce  json
 // @Param login path string true "Login"
 // @Success 200 {object} Player
-// @Failure 404 {object} map[string]string
+// @Failure 404 {object} Problem
+// @Failure 500 {object} Problem
+// @Failure 503 {object} Problem "Database is unavailable"
 // @Router /players/{login} [get]
 func GetPlayer(c *gin.Context) {
 	login := c.Param("login")
 
-	player, err := GetPlayerByLogin(login)
+	player, err := GetPlayerByLogin(c.Request.Context(), login)
 	if err != nil {
-		c.IndentedJSON(http.StatusNotFound, gin.H{"error": "player not found"})
+		respondError(c, err)
 		return
 	}
 
@@ -89,167 +170,540 @@ type PlayerRequest struct {
 // AddPlayer godoc
 // @Summary Add a new player
 // @Tags players
+// @x-v1 true
 // @Accept json
 // @Produce json
 // @Param player body PlayerRequest true "Player data"
 // @Success 200 {object} Player
-// @Failure 400 {object} map[string]string
-// @Failure 500 {object} map[string]string
+// @Failure 400 {object} Problem
+// @Failure 500 {object} Problem
+// @Failure 503 {object} Problem "Database is unavailable"
 // @Router /players [post]
 func AddPlayer(c *gin.Context) {
+	player, ok := registerPlayer(c)
+	if !ok {
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, gin.H{
+		"login": player.Login,
+		"score": player.Score,
+	})
+}
+
+// registerPlayer creates the player from the request body. On failure the response is already written
+func registerPlayer(c *gin.Context) (Player, bool) {
 	var json PlayerRequest
 
 	if err := c.ShouldBindJSON(&json); err != nil {
-		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
-		return
+		respondError(c, bindingError(err))
+		return Player{}, false
 	}
 
 	if !IsValidSHA256Hash(json.Password) {
-		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": "You gotta be kidding. Did you really just sent an unhashed password? 😂 Try SHA256"})
-		return
+		respondError(c, ErrUnhashedPassword)
+		return Player{}, false
 	}
 
-	player, err := CreatePlayer(json.Login, json.Password)
+	player, err := CreatePlayer(c.Request.Context(), json.Login, json.Password)
 	if err != nil {
-		var statusCode int
-
-		if errors.As(err, &ErrPlayerExists) || errors.As(err, &ErrNoSuchUser) {
-			statusCode = http.StatusBadRequest
-		} else {
-			statusCode = http.StatusInternalServerError
-		}
-
-		c.IndentedJSON(statusCode, gin.H{"error": err.Error()})
-		return
+		respondError(c, err)
+		return Player{}, false
 	}
 
-	c.IndentedJSON(http.StatusOK, gin.H{
-		"login": player.Login,
-		"score": player.Score,
-	})
+	audit(c, AuditRegister, player.Login, "")
+	registrations.Inc()
+
+	return player, true
 }
 
 type ScoreRequest struct {
 	Score uint `json:"score" binding:"required"`
+	// Difficulty (e.g. 6x6) and Seed (e.g. the date of a daily puzzle) count the score towards assignments
+	Difficulty string `json:"difficulty" binding:"max=32"`
+	Seed       string `json:"seed" binding:"max=32"`
 }
 
 // UpdatePlayer godoc
 // @Summary Update a player's score
 // @Tags players
-// @Description Updates the score for a player. Requires JWT authentication.
+// @x-v1 true
+// @Description Updates the score for a player. Requires JWT authentication. A difficulty and a seed count the score towards assignments.
 // @Accept json
 // @Produce json
-// @Param Authorization header string true "Bearer Token" format("Bearer <token>")
+// @Param Authorization header string false "Bearer Token, alternative to the Authorization cookie" format("Bearer <token>")
+// @Param X-CSRF-Token header string false "Token from /csrf, required with cookie authentication"
 // @Param login path string true "Login"
 // @Param body body ScoreRequest true "Score data"
 // @Success 200 {object} map[string]interface{} "Success"
-// @Failure 400 {object} map[string]string "Invalid input"
-// @Failure 401 {object} map[string]string "Unauthorized or missing token"
-// @Failure 403 {object} map[string]string "Unauthorized access"
-// @Failure 500 {object} map[string]string "Internal server error"
+// @Failure 400 {object} Problem "Invalid input"
+// @Failure 401 {object} Problem "Unauthorized or missing token"
+// @Failure 403 {object} Problem "Unauthorized access or missing CSRF token"
+// @Failure 404 {object} Problem "No such player"
+// @Failure 500 {object} Problem "Internal server error"
+// @Failure 503 {object} Problem "Database is unavailable"
 // @Router /players/{login} [put]
 func UpdatePlayer(c *gin.Context) {
-	tokenString, err := c.Cookie("Authorization")
+	login, _, score, ok := submitScore(c)
+	if !ok {
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, gin.H{
+		"login": login,
+		"score": score,
+	})
+}
+
+// submitScore records the score from the request body for the logged-in player and returns
+// the best score before and after it. On failure the response is already written
+func submitScore(c *gin.Context) (string, uint, uint, bool) {
+	claims, ok := authenticate(c)
+	if !ok {
+		return "", 0, 0, false
+	}
+
+	login := c.Param("login")
+	if login != claims.Login {
+		respondError(c, ErrForbidden)
+		return "", 0, 0, false
+	}
+
+	var json ScoreRequest
+
+	if err := c.ShouldBindJSON(&json); err != nil {
+		respondError(c, bindingError(err))
+		return "", 0, 0, false
+	}
+
+	oldScore, score, err := SetPlayerScore(c.Request.Context(), login, json.Score, json.Difficulty, json.Seed)
 	if err != nil {
-		c.IndentedJSON(http.StatusUnauthorized, gin.H{"error": "Missing authorization cookie"})
+		respondError(c, err)
+		return "", 0, 0, false
+	}
+
+	if score != oldScore {
+		audit(c, AuditScoreChange, login, scoreChangeDetails(oldScore, score))
+		scoreImprovements.Inc()
+	}
+
+	return login, oldScore, score, true
+}
+
+type PasswordChangeRequest struct {
+	OldPassword string `json:"old_password" binding:"required"`
+	NewPassword string `json:"new_password" binding:"required"`
+}
+
+// ChangePassword godoc
+// @Summary Change a player's password
+// @Tags players
+// @x-v1 true
+// @x-v2 true
+// @Description Requires the old password. Every existing session of the player is revoked, so the player has to log in again.
+// @Accept json
+// @Produce json
+// @Param login path string true "Login"
+// @Param body body PasswordChangeRequest true "Old and new SHA256 password hashes"
+// @Success 200 {object} map[string]string "Password changed"
+// @Failure 400 {object} Problem "Invalid input or wrong old password"
+// @Failure 401 {object} Problem "Unauthorized or missing token"
+// @Failure 403 {object} Problem "Unauthorized access or missing CSRF token"
+// @Failure 500 {object} Problem "Internal server error"
+// @Failure 503 {object} Problem "Database is unavailable"
+// @Router /players/{login}/password [put]
+func ChangePassword(c *gin.Context) {
+	claims, ok := authenticate(c)
+	if !ok {
+		return
+	}
+
+	login := c.Param("login")
+	if login != claims.Login {
+		respondError(c, ErrForbidden)
+		return
+	}
+
+	var json PasswordChangeRequest
+
+	if err := c.ShouldBindJSON(&json); err != nil {
+		respondError(c, bindingError(err))
+		return
+	}
+
+	if !IsValidSHA256Hash(json.OldPassword) || !IsValidSHA256Hash(json.NewPassword) {
+		respondError(c, ErrUnhashedPassword)
+		return
+	}
+
+	if err := ChangePlayerPassword(c.Request.Context(), login, json.OldPassword, json.NewPassword); err != nil {
+		respondError(c, err)
+		return
+	}
+
+	audit(c, AuditPasswordChange, login, "")
+	clearAuthCookie(c)
+
+	c.IndentedJSON(http.StatusOK, gin.H{"message": message(c, "password_changed")})
+}
+
+// RemovePlayer godoc
+// @Summary Delete a player's account
+// @Tags players
+// @x-v1 true
+// @x-v2 true
+// @Description Anonymizes the player by default: the score stays on the leaderboard under a placeholder login.
+// @Description With mode=delete the player and their sessions are removed for good. Audit entries are kept either way.
+// @Produce json
+// @Param login path string true "Login"
+// @Param mode query string false "anonymize (default) or delete" Enums(anonymize, delete)
+// @Success 200 {object} map[string]string "Account removed"
+// @Failure 400 {object} Problem "Invalid mode"
+// @Failure 401 {object} Problem "Unauthorized or missing token"
+// @Failure 403 {object} Problem "Unauthorized access or missing CSRF token"
+// @Failure 500 {object} Problem "Internal server error"
+// @Failure 503 {object} Problem "Database is unavailable"
+// @Router /players/{login} [delete]
+func RemovePlayer(c *gin.Context) {
+	claims, ok := authenticate(c)
+	if !ok {
+		return
+	}
+
+	login := c.Param("login")
+	if login != claims.Login {
+		respondError(c, ErrForbidden)
+		return
+	}
+
+	var err error
+
+	mode := c.DefaultQuery("mode", "anonymize")
+	switch mode {
+	case "anonymize":
+		err = AnonymizePlayer(c.Request.Context(), login)
+	case "delete":
+		err = DeletePlayer(c.Request.Context(), login)
+	default:
+		respondError(c, invalidParam("mode", "oneof", map[string]string{"values": "anonymize, delete"}))
 		return
 	}
 
-	claims, err := VerifyToken(tokenString)
 	if err != nil {
-		c.IndentedJSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired token"})
+		respondError(c, err)
+		return
+	}
+
+	audit(c, AuditPlayerDelete, login, mode)
+	clearAuthCookie(c)
+
+	c.IndentedJSON(http.StatusOK, gin.H{"message": message(c, "account_removed")})
+}
+
+type LanguageRequest struct {
+	Language string `json:"language" binding:"omitempty,oneof=en ro ru"`
+}
+
+// SetLanguage godoc
+// @Summary Set a player's preferred language
+// @Tags players
+// @x-v1 true
+// @x-v2 true
+// @Description Messages and errors are returned in this language instead of the one from Accept-Language. An empty language removes the preference.
+// @Accept json
+// @Produce json
+// @Param login path string true "Login"
+// @Param body body LanguageRequest true "en, ro, ru or empty"
+// @Success 200 {object} map[string]string "Language changed"
+// @Failure 400 {object} Problem "Invalid input"
+// @Failure 401 {object} Problem "Unauthorized or missing token"
+// @Failure 403 {object} Problem "Unauthorized access or missing CSRF token"
+// @Failure 500 {object} Problem "Internal server error"
+// @Failure 503 {object} Problem "Database is unavailable"
+// @Router /players/{login}/language [put]
+func SetLanguage(c *gin.Context) {
+	claims, ok := authenticate(c)
+	if !ok {
 		return
 	}
 
 	login := c.Param("login")
 	if login != claims.Login {
-		c.IndentedJSON(http.StatusForbidden, gin.H{"error": "Unauthorized access"})
+		respondError(c, ErrForbidden)
 		return
 	}
 
-	var json ScoreRequest
+	var json LanguageRequest
 
 	if err := c.ShouldBindJSON(&json); err != nil {
-		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
+		respondError(c, bindingError(err))
+		return
+	}
+
+	if err := SetPlayerLanguage(c.Request.Context(), login, json.Language); err != nil {
+		respondError(c, err)
 		return
 	}
 
-	score, err := SetPlayerScore(login, json.Score)
+	c.Set("language", "") // pick the new preference up for this response already
+	c.IndentedJSON(http.StatusOK, gin.H{"message": message(c, "language_changed")})
+}
+
+// ExportPlayer godoc
+// @Summary Request a personal data export
+// @Tags players
+// @x-v1 true
+// @x-v2 true
+// @Description Queues a zip archive (JSON and CSV) with everything stored about the player and returns the job.
+// @Description Poll the job until it is done, then download the archive. Requesting again while a job is unfinished returns that job.
+// @Produce json
+// @Param login path string true "Login"
+// @Success 202 {object} ExportJob
+// @Failure 401 {object} Problem "Unauthorized or missing token"
+// @Failure 403 {object} Problem "Unauthorized access"
+// @Failure 500 {object} Problem "Internal server error"
+// @Failure 503 {object} Problem "Database is unavailable"
+// @Router /players/{login}/export [get]
+func ExportPlayer(c *gin.Context) {
+	claims, ok := authenticate(c)
+	if !ok {
+		return
+	}
+
+	login := c.Param("login")
+	if login != claims.Login {
+		respondError(c, ErrForbidden)
+		return
+	}
+
+	job, err := RequestExport(c.Request.Context(), login)
 	if err != nil {
-		var statusCode int
+		respondError(c, err)
+		return
+	}
+
+	c.Header("Location", fmt.Sprintf("%s/players/%s/export/%s", routePrefix(c, "/players/:login/export"), login, job.ID))
+	c.IndentedJSON(http.StatusAccepted, job)
+}
 
-		if errors.As(err, &ErrNoSuchPlayer) {
-			statusCode = http.StatusBadRequest
-		} else {
-			statusCode = http.StatusInternalServerError
+// GetExport godoc
+// @Summary Get the status of a personal data export
+// @Tags players
+// @x-v1 true
+// @x-v2 true
+// @Produce json
+// @Param login path string true "Login"
+// @Param id path string true "Export job ID"
+// @Success 200 {object} ExportJob
+// @Failure 401 {object} Problem "Unauthorized or missing token"
+// @Failure 403 {object} Problem "Unauthorized access"
+// @Failure 404 {object} Problem "No such export"
+// @Router /players/{login}/export/{id} [get]
+func GetExport(c *gin.Context) {
+	job, ok := ownExportJob(c)
+	if !ok {
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, job)
+}
+
+// DownloadExport godoc
+// @Summary Download a finished personal data export
+// @Tags players
+// @x-v1 true
+// @x-v2 true
+// @Produce application/zip
+// @Param login path string true "Login"
+// @Param id path string true "Export job ID"
+// @Success 200 {file} file "Zip archive"
+// @Failure 401 {object} Problem "Unauthorized or missing token"
+// @Failure 403 {object} Problem "Unauthorized access"
+// @Failure 404 {object} Problem "No such export"
+// @Failure 409 {object} Problem "Export is not finished"
+// @Router /players/{login}/export/{id}/archive [get]
+func DownloadExport(c *gin.Context) {
+	job, ok := ownExportJob(c)
+	if !ok {
+		return
+	}
+
+	if job.Status != ExportDone {
+		respondError(c, ErrExportNotReady)
+		return
+	}
+
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s-export.zip"`, job.Login))
+	c.Data(http.StatusOK, "application/zip", job.Archive)
+}
+
+// ownExportJob loads the export job from the path if it belongs to the logged-in player
+func ownExportJob(c *gin.Context) (ExportJob, bool) {
+	claims, ok := authenticate(c)
+	if !ok {
+		return ExportJob{}, false
+	}
+
+	login := c.Param("login")
+	if login != claims.Login {
+		respondError(c, ErrForbidden)
+		return ExportJob{}, false
+	}
+
+	job, err := GetExportJob(c.Request.Context(), login, c.Param("id"))
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			err = ErrExportNotFound
 		}
-		c.IndentedJSON(statusCode, gin.H{"error": err.Error()})
+		respondError(c, err)
+		return ExportJob{}, false
+	}
+
+	return job, true
+}
+
+// clearAuthCookie drops the Authorization cookie of a player whose sessions were just revoked
+func clearAuthCookie(c *gin.Context) {
+	if _, ok := bearerToken(c); ok {
 		return
 	}
 
-	c.IndentedJSON(http.StatusOK, gin.H{
-		"login": login,
-		"score": score,
-	})
+	c.SetSameSite(http.SameSiteNoneMode)
+	c.SetCookie("Authorization", "", -1, "/", c.Request.Host, true, true)
 }
 
 // LoginPlayer handles the login process and sets the JWT token in Authorization header
 // @Summary Log in a player
+// @x-v1 true
 // @Description Authenticates a player and returns a JWT token in an HTTP-only cookie.
 // @Accept json
 // @Produce json
 // @Param request body PlayerRequest true "Player login request"
 // @Success 200 {object} map[string]string "Login successful"
-// @Failure 400 {object} map[string]string "Invalid input or incorrect credentials"
-// @Failure 500 {object} map[string]string "Internal server error"
+// @Failure 400 {object} Problem "Invalid input or incorrect credentials"
+// @Failure 403 {object} Problem "Account deactivated after leaving the course"
+// @Failure 429 {object} Problem "Too many failed attempts, see Retry-After"
+// @Failure 500 {object} Problem "Internal server error"
+// @Failure 503 {object} Problem "Database is unavailable"
 // @Router /login [post]
 func LoginPlayer(c *gin.Context) {
+	_, token, tokenExpiry, ok := login(c)
+	if !ok {
+		return
+	}
+
+	domain := c.Request.Host
+
+	c.SetSameSite(http.SameSiteNoneMode) // otherwise cross-site response will block setting the cookie
+	c.SetCookie("Authorization", token, int(tokenExpiry.Seconds())*2, "/", domain, true, true)
+
+	c.IndentedJSON(http.StatusOK, gin.H{"message": message(c, "login_success")})
+}
+
+// login checks the credentials with brute-force protection and opens a session.
+// It returns the player, the signed token and its lifetime. On failure the response is already written
+func login(c *gin.Context) (Player, string, time.Duration, bool) {
 	var json PlayerRequest
 
 	if err := c.ShouldBindJSON(&json); err != nil {
-		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
-		return
+		respondError(c, bindingError(err))
+		return Player{}, "", 0, false
 	}
 
 	if !IsValidSHA256Hash(json.Password) {
-		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": "You gotta be kidding. Did you really just sent an unhashed password? 😂 Try SHA256"})
-		return
+		respondError(c, ErrUnhashedPassword)
+		return Player{}, "", 0, false
 	}
 
-	player, err := GetPlayerByLogin(json.Login)
+	ip := c.ClientIP()
+
+	loginWait, err := LoginPolicy.RetryAfter(loginKey(c.Request.Context(), json.Login))
 	if err != nil {
-		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-		return
+		respondError(c, err)
+		return Player{}, "", 0, false
 	}
 
-	if player.Password != json.Password {
-		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": "Wrong password"})
-		return
+	ipWait, err := IPPolicy.RetryAfter(ipKey(ip))
+	if err != nil {
+		respondError(c, err)
+		return Player{}, "", 0, false
+	}
+
+	if wait := max(loginWait, ipWait); wait > 0 {
+		logins.WithLabelValues("locked").Inc()
+		setRetryAfter(c, wait)
+		respondError(c, ErrTooManyLoginAttempts)
+		return Player{}, "", 0, false
+	}
+
+	player, err := GetPlayerByLogin(c.Request.Context(), json.Login)
+	if err != nil && !errors.As(err, &ErrNoSuchPlayer) {
+		respondError(c, err)
+		return Player{}, "", 0, false
 	}
 
-	expirationStr := os.Getenv("EXPIRATION_TIME")
+	// one answer for unknown logins and wrong passwords, so logins cannot be enumerated
+	if err != nil || player.Password != json.Password {
+		reason := "wrong password"
+		if err != nil {
+			reason = err.Error()
+		}
+		audit(c, AuditLoginFailure, json.Login, reason)
+		logins.WithLabelValues("failure").Inc()
+
+		loginWait, loginErr := LoginPolicy.Fail(loginKey(c.Request.Context(), json.Login))
+		ipWait, ipErr := IPPolicy.Fail(ipKey(ip))
+		if loginErr != nil || ipErr != nil {
+			logger(c.Request.Context()).Error("failed to record login failure",
+				slog.String("login", json.Login), slog.String("ip", ip), slog.Any("error", errors.Join(loginErr, ipErr)))
+		}
 
-	expirationMinutes, _ := strconv.Atoi(expirationStr)
-	var tokenExpiry = time.Minute * time.Duration(expirationMinutes)
-	tokenExpirySeconds := int(tokenExpiry.Seconds())
+		if wait := max(loginWait, ipWait); wait > 0 {
+			setRetryAfter(c, wait)
+		}
+		respondError(c, ErrInvalidCredentials)
+		return Player{}, "", 0, false
+	}
+
+	if player.DeactivatedAt != nil {
+		audit(c, AuditLoginFailure, player.Login, "account deactivated")
+		logins.WithLabelValues("failure").Inc()
+		respondError(c, ErrAccountDeactivated)
+		return Player{}, "", 0, false
+	}
 
-	token, err := GenerateJWT(player.Login, tokenExpiry)
+	if err := ResetLoginAttempts(loginKey(c.Request.Context(), player.Login)); err != nil {
+		logger(c.Request.Context()).Error("failed to reset login attempts", slog.String("login", player.Login), slog.Any("error", err))
+	}
+
+	session, err := CreateSession(c.Request.Context(), player.Login, ip, c.Request.UserAgent(), tokenExpiry)
 	if err != nil {
-		c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
+		respondError(c, err)
+		return Player{}, "", 0, false
 	}
 
-	domain := c.Request.Host
+	token, err := GenerateJWT(player.Login, courseFrom(c.Request.Context()).namespace(), session.ID, tokenExpiry)
+	if err != nil {
+		respondError(c, err)
+		return Player{}, "", 0, false
+	}
 
-	c.SetSameSite(http.SameSiteNoneMode) // otherwise cross-site response will block setting the cookie
-	c.SetCookie("Authorization", token, tokenExpirySeconds*2, "/", domain, true, true)
+	audit(c, AuditLoginSuccess, player.Login, "")
+	logins.WithLabelValues("success").Inc()
 
-	c.IndentedJSON(http.StatusOK, gin.H{"message": "success"})
+	return player, token, tokenExpiry, true
+}
+
+// setRetryAfter rounds the wait up to whole seconds as the Retry-After header requires
+func setRetryAfter(c *gin.Context, wait time.Duration) {
+	c.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
 }
 
 // Ping godoc
 // @Summary Ping test endpoint
 // @Tags ping
+// @x-v1 true
+// @x-v2 true
 // @Produce  json
 // @Success 200 {object} map[string]string
 // @Router /ping [get]
@@ -257,34 +711,144 @@ func Ping(c *gin.Context) {
 	c.IndentedJSON(http.StatusOK, gin.H{"ping": "pong"})
 }
 
-func initAPI(port int) {
-	router := gin.Default()
+// mustParseRateLimit is for limits the configuration has already validated
+func mustParseRateLimit(value string) RateLimit {
+	limit, err := ParseRateLimit(value)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return limit
+}
+
+// routeLimits are the rate limiters shared by every API version, so switching versions does not reset a budget
+type routeLimits struct {
+	auth  gin.HandlerFunc
+	score gin.HandlerFunc
+	read  gin.HandlerFunc
+	admin gin.HandlerFunc
+}
+
+// registerV1 adds the cookie-authenticated API that used to live at the root
+func registerV1(r *gin.RouterGroup, limits routeLimits) {
+	r.Use(CSRFProtected())
+
+	// anonymous endpoints are always keyed by address, there is no login to key by yet
+	auth := r.Group("/", limits.auth)
+	auth.POST("/players", AddPlayer)
+	auth.POST("/login", LoginPlayer)
+
+	auth.PUT("/players/:login/password", ChangePassword)
+	auth.DELETE("/players/:login", RemovePlayer)
+
+	scores := r.Group("/", limits.score)
+	scores.PUT("/players/:login", UpdatePlayer)
+	scores.PUT("/players/:login/language", SetLanguage)
+
+	reads := r.Group("/", limits.read)
+	reads.GET("/csrf", GetCSRFToken)
+	reads.GET("/users", ListUsers)
+	reads.GET("/users/:username", GetUser)
+	reads.GET("/players", ListPlayers)
+	reads.GET("/players/:login", GetPlayer)
+	reads.GET("/players/:login/export", ExportPlayer)
+	reads.GET("/players/:login/export/:id", GetExport)
+	reads.GET("/players/:login/export/:id/archive", DownloadExport)
+	reads.GET("/groups", ListGroups)
+	reads.GET("/groups/standings", ListGroupStandings)
+	reads.GET("/assignments", ListAssignments)
+
+	// admin calls change state or are expensive, they get a budget of their own
+	admin := r.Group("/admin", limits.admin, AdminOnly())
+	admin.GET("/audit", ListAuditEntries)
+	admin.POST("/players/:login/unlock", UnlockPlayer)
+	admin.PUT("/players/:login/password", ResetPassword)
+	admin.POST("/roster", UploadRoster)
+	admin.GET("/grades", ExportGrades)
+	admin.GET("/assignments", ListAssignmentStats)
+	admin.POST("/assignments", AddAssignment)
+	admin.GET("/assignments/:id", GetAssignmentProgress)
+	admin.DELETE("/assignments/:id", RemoveAssignment)
+	admin.POST("/groups", AddGroup)
+	admin.DELETE("/groups/:group", RemoveGroup)
+	admin.POST("/groups/:group/members", UploadGroupMembers)
+	admin.PUT("/groups/:group/members/:login", AddGroupMember)
+	admin.DELETE("/groups/:group/members/:login", RemoveGroupMember)
+}
+
+// newRouter wires every route and middleware of the public API
+func newRouter(cfg Config) *gin.Engine {
+	// a missing translation falls back to English, not worth refusing to start over
+	if err := validateCatalogue(); err != nil {
+		slog.Error("starting with an incomplete message catalogue", slog.Any("error", err))
+	}
+	registerJSONFieldNames()
 
-	allowedHostsEnv := os.Getenv("ALLOWED_HOSTS")
+	router := gin.New()
+	router.Use(Tracing(), RequestLogging(), Recovery(), Metrics())
+	mountMetrics(router, cfg.Metrics)
 
 	router.Use(cors.New(cors.Config{
-		AllowOrigins:     strings.Split(allowedHostsEnv, ","),
+		AllowOrigins:     cfg.AllowedHosts,
 		AllowMethods:     []string{"PUT", "POST", "GET", "OPTIONS", "DELETE"},
-		AllowHeaders:     []string{"Content-Type", "Content-Length", "Accept-Encoding", "X-CSRF-Token", "Authorization", "accept", "origin", "Cache-Control", "X-Requested-With"},
-		ExposeHeaders:    []string{"Content-Length"},
+		AllowHeaders:     []string{"Content-Type", "X-Request-ID", "Content-Length", "Accept-Encoding", "X-CSRF-Token", "Authorization", "accept", "origin", "Cache-Control", "X-Requested-With"},
+		ExposeHeaders:    []string{"Content-Length", "X-Request-ID", "Link", "X-Total-Count", "Retry-After", "RateLimit-Limit", "RateLimit-Remaining", "RateLimit-Reset", "RateLimit-Policy", "Deprecation", "Sunset"},
 		AllowCredentials: true,
 		MaxAge:           12 * time.Hour,
 	}))
 
-	router.GET("/ping", Ping)
+	if cfg.RateLimit.Store == "db" {
+		RateLimitStore = NewDBBucketStore(GameDB)
+	}
+
+	rateKey := RateKeyByIP
+	if cfg.RateLimit.Key == "login" {
+		rateKey = RateKeyByLogin
+	}
+
+	authLimit := mustParseRateLimit(cfg.RateLimit.Auth)
+	scoreLimit := mustParseRateLimit(cfg.RateLimit.Score)
+	readLimit := mustParseRateLimit(cfg.RateLimit.Read)
+	adminLimit := mustParseRateLimit(cfg.RateLimit.Admin)
+
+	limits := routeLimits{
+		auth:  RateLimited("auth", authLimit, RateKeyByIP),
+		score: RateLimited("score", scoreLimit, rateKey),
+		read:  RateLimited("read", readLimit, rateKey),
+		admin: RateLimited("admin", adminLimit, rateKey),
+	}
 
-	router.GET("/users", ListUsers)
-	router.GET("/users/:username", GetUser)
+	// probes answer under every version prefix so clients can stay on one base URL
+	for _, prefix := range []string{"", "/v1", "/v2"} {
+		router.GET(prefix+"/ping", Ping)
+		router.GET(prefix+"/healthz", Healthz)
+		router.GET(prefix+"/readyz", Readyz)
+		router.GET(prefix+"/version", Version)
+	}
 
-	router.GET("/players", ListPlayers)
-	router.GET("/players/:login", GetPlayer)
-	router.POST("/players", AddPlayer)
-	router.PUT("/players/:login", UpdatePlayer)
+	// everything but the probes and the docs needs the database
+	api := router.Group("/", RequireDB())
 
-	router.POST("/login", LoginPlayer)
+	// the course list is the one route outside of every course
+	for _, prefix := range []string{"", "/v1", "/v2"} {
+		api.GET(prefix+"/courses", limits.read, ListCourses)
+	}
+
+	// every version answers for the default course, its subdomain and the /courses/<course> prefix
+	for _, course := range []*gin.RouterGroup{
+		api.Group("/", CourseScope(cfg.CourseDomain)),
+		api.Group("/courses/:course", CourseScope(cfg.CourseDomain)),
+	} {
+		registerV1(course.Group("/", Deprecated(legacySunset(cfg.LegacySunset))), limits)
+		registerV1(course.Group("/v1"), limits)
+		registerV2(course.Group("/v2", BearerOnly()), limits)
+	}
 
-	// Swagger documentation route
+	// Swagger documentation routes, one document per version
+	docsv1.SwaggerInfov1.BasePath = "/v1"
+	docsv2.SwaggerInfov2.BasePath = "/v2"
 	router.GET("/swagger/*any", ginSwagger.WrapHandler(swaggerfiles.Handler))
+	router.GET("/v1/swagger/*any", ginSwagger.WrapHandler(swaggerfiles.Handler, ginSwagger.InstanceName(docsv1.SwaggerInfov1.InstanceName())))
+	router.GET("/v2/swagger/*any", ginSwagger.WrapHandler(swaggerfiles.Handler, ginSwagger.InstanceName(docsv2.SwaggerInfov2.InstanceName())))
 
-	router.Run(fmt.Sprintf(":%d", port))
+	return router
 }
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"time"
+)
+
+// PlayerV2 is a player as the v2 API shows it
+type PlayerV2 struct {
+	Login string `json:"login"`
+	Score uint   `json:"score"`
+}
+
+// UserV2 is a course user as the v2 API shows it
+type UserV2 struct {
+	Username string `json:"username"`
+	Name     string `json:"name"`
+}
+
+type PlayerPageV2 struct {
+	Items []PlayerV2 `json:"items"`
+	Total int64      `json:"total"`
+	Next  string     `json:"next,omitempty"` // cursor for the after parameter, empty on the last page
+}
+
+type UserPageV2 struct {
+	Items []UserV2 `json:"items"`
+	Total int64    `json:"total"`
+	Next  string   `json:"next,omitempty"` // cursor for the after parameter, empty on the last page
+}
+
+type ScoreV2 struct {
+	Login         string `json:"login"`
+	Score         uint   `json:"score"`
+	PreviousScore uint   `json:"previous_score"`
+	Improved      bool   `json:"improved"`
+}
+
+type TokenV2 struct {
+	Token     string    `json:"token"`
+	TokenType string    `json:"token_type"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+func playerV2(player Player) PlayerV2 {
+	return PlayerV2{Login: player.Login, Score: player.Score}
+}
+
+// registerV2 adds the bearer-authenticated API with snake_case bodies and paginated envelopes.
+// Endpoints whose contract did not change share their v1 handlers
+func registerV2(r *gin.RouterGroup, limits routeLimits) {
+	auth := r.Group("/", limits.auth)
+	auth.POST("/players", AddPlayerV2)
+	auth.POST("/login", LoginV2)
+
+	auth.PUT("/players/:login/password", ChangePassword)
+	auth.DELETE("/players/:login", RemovePlayer)
+
+	scores := r.Group("/", limits.score)
+	scores.PUT("/players/:login/score", SubmitScoreV2)
+	scores.PUT("/players/:login/language", SetLanguage)
+
+	reads := r.Group("/", limits.read)
+	reads.GET("/users", ListUsersV2)
+	reads.GET("/users/:username", GetUserV2)
+	reads.GET("/players", ListPlayersV2)
+	reads.GET("/players/:login", GetPlayerV2)
+	reads.GET("/players/:login/export", ExportPlayer)
+	reads.GET("/players/:login/export/:id", GetExport)
+	reads.GET("/players/:login/export/:id/archive", DownloadExport)
+	reads.GET("/groups", ListGroups)
+	reads.GET("/groups/standings", ListGroupStandings)
+	reads.GET("/assignments", ListAssignments)
+
+	admin := r.Group("/admin", limits.admin, AdminOnly())
+	admin.GET("/audit", ListAuditEntries)
+	admin.POST("/players/:login/unlock", UnlockPlayer)
+	admin.PUT("/players/:login/password", ResetPassword)
+	admin.POST("/roster", UploadRoster)
+	admin.GET("/grades", ExportGrades)
+	admin.GET("/assignments", ListAssignmentStats)
+	admin.POST("/assignments", AddAssignment)
+	admin.GET("/assignments/:id", GetAssignmentProgress)
+	admin.DELETE("/assignments/:id", RemoveAssignment)
+	admin.POST("/groups", AddGroup)
+	admin.DELETE("/groups/:group", RemoveGroup)
+	admin.POST("/groups/:group/members", UploadGroupMembers)
+	admin.PUT("/groups/:group/members/:login", AddGroupMember)
+	admin.DELETE("/groups/:group/members/:login", RemoveGroupMember)
+}
+
+// ListUsersV2 godoc
+// @Summary List users
+// @Tags users
+// @x-v2 true
+// @Produce json
+// @Param limit query int false "Page size (default 50, max 500)"
+// @Param after query string false "Cursor from next of the previous page"
+// @Param sort query string false "username or name, prefix with - for descending order" default(username)
+// @Param username query string false "Username prefix"
+// @Success 200 {object} UserPageV2
+// @Failure 400 {object} Problem
+// @Failure 500 {object} Problem
+// @Failure 503 {object} Problem "Database is unavailable"
+// @Router /users [get]
+func ListUsersV2(c *gin.Context) {
+	page, err := parsePage(c, userSorts, "username")
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	users, total, next, err := Users.FindUsers(c.Request.Context(), UserFilter{UsernamePrefix: c.Query("username")}, page)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	items := make([]UserV2, len(users))
+	for i, user := range users {
+		items[i] = UserV2{Username: user.Username, Name: user.Name}
+	}
+
+	c.IndentedJSON(http.StatusOK, UserPageV2{Items: items, Total: total, Next: next})
+}
+
+// GetUserV2 godoc
+// @Summary Get a user by username
+// @Tags users
+// @x-v2 true
+// @Produce json
+// @Param username path string true "Username"
+// @Success 200 {object} UserV2
+// @Failure 404 {object} Problem
+// @Failure 500 {object} Problem
+// @Failure 503 {object} Problem "Database is unavailable"
+// @Router /users/{username} [get]
+func GetUserV2(c *gin.Context) {
+	user, err := Users.GetUser(c.Request.Context(), c.Param("username"))
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, UserV2{Username: user.Username, Name: user.Name})
+}
+
+// ListPlayersV2 godoc
+// @Summary List players
+// @Tags players
+// @x-v2 true
+// @Produce json
+// @Param limit query int false "Page size (default 50, max 500)"
+// @Param after query string false "Cursor from next of the previous page"
+// @Param sort query string false "score, login or created, prefix with - for descending order" default(-score)
+// @Param min_score query int false "Only players with at least this score"
+// @Param login query string false "Login prefix"
+// @Param group query string false "Only members of the group with this slug, a per-group leaderboard"
+// @Success 200 {object} PlayerPageV2
+// @Failure 400 {object} Problem
+// @Failure 404 {object} Problem "No such group"
+// @Failure 500 {object} Problem
+// @Failure 503 {object} Problem "Database is unavailable"
+// @Router /players [get]
+func ListPlayersV2(c *gin.Context) {
+	page, err := parsePage(c, playerSorts, "-score")
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	filter, err := playerFilterFromQuery(c)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	players, total, next, err := FindPlayers(c.Request.Context(), filter, page)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	items := make([]PlayerV2, len(players))
+	for i, player := range players {
+		items[i] = playerV2(player)
+	}
+
+	c.IndentedJSON(http.StatusOK, PlayerPageV2{Items: items, Total: total, Next: next})
+}
+
+// GetPlayerV2 godoc
+// @Summary Get a player by login
+// @Tags players
+// @x-v2 true
+// @Produce json
+// @Param login path string true "Login"
+// @Success 200 {object} PlayerV2
+// @Failure 404 {object} Problem
+// @Failure 500 {object} Problem
+// @Failure 503 {object} Problem "Database is unavailable"
+// @Router /players/{login} [get]
+func GetPlayerV2(c *gin.Context) {
+	player, err := GetPlayerByLogin(c.Request.Context(), c.Param("login"))
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, playerV2(player))
+}
+
+// AddPlayerV2 godoc
+// @Summary Register a new player
+// @Tags players
+// @x-v2 true
+// @Accept json
+// @Produce json
+// @Param player body PlayerRequest true "Player data"
+// @Success 201 {object} PlayerV2
+// @Failure 400 {object} Problem
+// @Failure 500 {object} Problem
+// @Failure 503 {object} Problem "Database is unavailable"
+// @Router /players [post]
+func AddPlayerV2(c *gin.Context) {
+	player, ok := registerPlayer(c)
+	if !ok {
+		return
+	}
+
+	c.Header("Location", routePrefix(c, "/players")+"/players/"+player.Login)
+	c.IndentedJSON(http.StatusCreated, playerV2(player))
+}
+
+// SubmitScoreV2 godoc
+// @Summary Submit a score
+// @Tags players
+// @x-v2 true
+// @Description Records the score. The player's best score only changes when the new one is higher. A difficulty and a seed count the score towards assignments.
+// @Accept json
+// @Produce json
+// @Param Authorization header string true "Bearer Token" format("Bearer <token>")
+// @Param login path string true "Login"
+// @Param body body ScoreRequest true "Score data"
+// @Success 200 {object} ScoreV2
+// @Failure 400 {object} Problem "Invalid input"
+// @Failure 401 {object} Problem "Unauthorized or missing token"
+// @Failure 403 {object} Problem "Unauthorized access"
+// @Failure 404 {object} Problem "No such player"
+// @Failure 500 {object} Problem "Internal server error"
+// @Failure 503 {object} Problem "Database is unavailable"
+// @Router /players/{login}/score [put]
+func SubmitScoreV2(c *gin.Context) {
+	login, oldScore, score, ok := submitScore(c)
+	if !ok {
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, ScoreV2{
+		Login:         login,
+		Score:         score,
+		PreviousScore: oldScore,
+		Improved:      score > oldScore,
+	})
+}
+
+// LoginV2 godoc
+// @Summary Log in a player
+// @Tags auth
+// @x-v2 true
+// @Description Returns a bearer token for the Authorization header. No cookie is set.
+// @Accept json
+// @Produce json
+// @Param request body PlayerRequest true "Player login request"
+// @Success 200 {object} TokenV2
+// @Failure 400 {object} Problem "Invalid input or incorrect credentials"
+// @Failure 403 {object} Problem "Account deactivated after leaving the course"
+// @Failure 429 {object} Problem "Too many failed attempts, see Retry-After"
+// @Failure 500 {object} Problem "Internal server error"
+// @Failure 503 {object} Problem "Database is unavailable"
+// @Router /login [post]
+func LoginV2(c *gin.Context) {
+	_, token, tokenExpiry, ok := login(c)
+	if !ok {
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, TokenV2{
+		Token:     token,
+		TokenType: "Bearer",
+		ExpiresAt: time.Now().Add(tokenExpiry).UTC(),
+	})
+}
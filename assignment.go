@@ -0,0 +1,399 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Assignment statuses of a player, computed from the scores they submitted since the assignment opened
+const (
+	AssignmentNotStarted = "not_started"
+	AssignmentInProgress = "in_progress" // played, target not reached
+	AssignmentAchieved   = "achieved"    // target reached by the due time
+	AssignmentLate       = "late"        // target first reached after the due time
+)
+
+// Assignment asks for a target score on a difficulty level, a seed (a daily puzzle) or both,
+// between its opening and due time
+type Assignment struct {
+	ID          uint      `gorm:"primarykey" json:"id"`
+	CourseID    uint      `gorm:"not null" json:"-"`
+	CreatedAt   time.Time `json:"-"`
+	Title       string    `gorm:"not null" json:"title"`
+	Difficulty  string    `gorm:"not null;default:''" json:"difficulty,omitempty"`
+	Seed        string    `gorm:"not null;default:''" json:"seed,omitempty"`
+	TargetScore uint      `gorm:"not null" json:"target_score"`
+	OpensAt     time.Time `gorm:"not null" json:"opens_at"`
+	DueAt       time.Time `gorm:"not null" json:"due_at"`
+}
+
+type AssignmentRequest struct {
+	Title       string    `json:"title" binding:"required,max=200"`
+	Difficulty  string    `json:"difficulty" binding:"max=32"`
+	Seed        string    `json:"seed" binding:"max=32"`
+	TargetScore uint      `json:"target_score" binding:"required"`
+	OpensAt     time.Time `json:"opens_at" binding:"required"`
+	DueAt       time.Time `json:"due_at" binding:"required"`
+}
+
+// AssignmentProgress is where one player stands on an assignment
+type AssignmentProgress struct {
+	Login     string     `json:"login"`
+	Status    string     `json:"status"`
+	BestScore uint       `json:"best_score"`
+	Attempts  int        `json:"attempts"`             // matching scores submitted since the assignment opened
+	ReachedAt *time.Time `json:"reached_at,omitempty"` // first score at or above the target, on time or late
+}
+
+// PlayerAssignment is an assignment as the player working on it sees it
+type PlayerAssignment struct {
+	Assignment
+	Progress AssignmentProgress `json:"progress"`
+}
+
+// AssignmentStats counts the students of the course per status. Instructors are not counted
+type AssignmentStats struct {
+	Assignment
+	Players    int `json:"players"`
+	NotStarted int `json:"not_started"`
+	InProgress int `json:"in_progress"`
+	Achieved   int `json:"achieved"`
+	Late       int `json:"late"`
+	// Completion is the share of players who achieved the target on time
+	Completion float64 `json:"completion"`
+}
+
+func (p *AssignmentProgress) setStatus(assignment Assignment) {
+	switch {
+	case p.ReachedAt != nil && !p.ReachedAt.After(assignment.DueAt):
+		p.Status = AssignmentAchieved
+	case p.ReachedAt != nil:
+		p.Status = AssignmentLate
+	case p.Attempts > 0:
+		p.Status = AssignmentInProgress
+	default:
+		p.Status = AssignmentNotStarted
+	}
+}
+
+func GetAssignment(ctx context.Context, id uint) (Assignment, error) {
+	var assignment Assignment
+	result := GameDB.WithContext(ctx).Scopes(inCourse).First(&assignment, id)
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return assignment, ErrAssignmentNotFound
+	}
+	return assignment, result.Error
+}
+
+// FindAssignments lists the assignments of the course by due time. With open set, only the ones opened by now
+func FindAssignments(ctx context.Context, open bool) ([]Assignment, error) {
+	query := GameDB.WithContext(ctx).Scopes(inCourse)
+	if open {
+		query = query.Where("opens_at <= ?", time.Now())
+	}
+
+	var assignments []Assignment
+	result := query.Order("due_at").Order("id").Find(&assignments)
+	return assignments, result.Error
+}
+
+func CreateAssignment(ctx context.Context, request AssignmentRequest) (Assignment, error) {
+	if request.Difficulty == "" && request.Seed == "" {
+		return Assignment{}, invalidParam("difficulty", "required_without", map[string]string{"other": "seed"})
+	}
+	if !request.DueAt.After(request.OpensAt) {
+		return Assignment{}, invalidParam("due_at", "after", map[string]string{"other": "opens_at"})
+	}
+
+	assignment := Assignment{
+		CourseID:    courseFrom(ctx).ID,
+		Title:       request.Title,
+		Difficulty:  request.Difficulty,
+		Seed:        request.Seed,
+		TargetScore: request.TargetScore,
+		OpensAt:     request.OpensAt,
+		DueAt:       request.DueAt,
+	}
+	result := GameDB.WithContext(ctx).Create(&assignment)
+	return assignment, result.Error
+}
+
+func DeleteAssignment(ctx context.Context, id uint) error {
+	result := GameDB.WithContext(ctx).Scopes(inCourse).Delete(&Assignment{}, id)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrAssignmentNotFound
+	}
+	return nil
+}
+
+// assignmentProgress computes the progress of the player with login, or of every student of the course
+// when login is empty. Only scores submitted since the opening on the assignment's difficulty and seed count
+func assignmentProgress(ctx context.Context, assignment Assignment, login string) ([]AssignmentProgress, error) {
+	students := "AND NOT players.is_admin"
+	if login != "" {
+		students = "AND players.login = @login"
+	}
+
+	var progress []AssignmentProgress
+	err := GameDB.WithContext(ctx).Raw(`SELECT players.login,
+			COUNT(score_records.id) AS attempts,
+			COALESCE(MAX(score_records.score), 0) AS best_score,
+			MIN(score_records.created_at) FILTER (WHERE score_records.score >= @target) AS reached_at
+		FROM players
+		LEFT JOIN score_records ON score_records.player_id = players.id
+			AND score_records.created_at >= @opens
+			AND (@difficulty = '' OR score_records.difficulty = @difficulty)
+			AND (@seed = '' OR score_records.seed = @seed)
+		WHERE players.course_id = @course AND players.deleted_at IS NULL AND players.deactivated_at IS NULL `+students+`
+		GROUP BY players.login
+		ORDER BY players.login`, map[string]interface{}{
+		"target":     assignment.TargetScore,
+		"opens":      assignment.OpensAt,
+		"difficulty": assignment.Difficulty,
+		"seed":       assignment.Seed,
+		"course":     assignment.CourseID,
+		"login":      login,
+	}).Scan(&progress).Error
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range progress {
+		progress[i].setStatus(assignment)
+	}
+	return progress, nil
+}
+
+// PlayerAssignments lists the opened assignments of the course with the progress of the player with login
+func PlayerAssignments(ctx context.Context, login string) ([]PlayerAssignment, error) {
+	assignments, err := FindAssignments(ctx, true)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]PlayerAssignment, len(assignments))
+	for i, assignment := range assignments {
+		progress, err := assignmentProgress(ctx, assignment, login)
+		if err != nil {
+			return nil, err
+		}
+
+		result[i] = PlayerAssignment{Assignment: assignment, Progress: AssignmentProgress{Login: login, Status: AssignmentNotStarted}}
+		if len(progress) > 0 {
+			result[i].Progress = progress[0]
+		}
+	}
+	return result, nil
+}
+
+func assignmentStats(assignment Assignment, progress []AssignmentProgress) AssignmentStats {
+	stats := AssignmentStats{Assignment: assignment, Players: len(progress)}
+	for _, p := range progress {
+		switch p.Status {
+		case AssignmentNotStarted:
+			stats.NotStarted++
+		case AssignmentInProgress:
+			stats.InProgress++
+		case AssignmentAchieved:
+			stats.Achieved++
+		case AssignmentLate:
+			stats.Late++
+		}
+	}
+	if stats.Players > 0 {
+		stats.Completion = float64(stats.Achieved) / float64(stats.Players)
+	}
+	return stats
+}
+
+// AllAssignmentStats lists every assignment of the course, opened or not, with completion counts
+func AllAssignmentStats(ctx context.Context) ([]AssignmentStats, error) {
+	assignments, err := FindAssignments(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+
+	stats := make([]AssignmentStats, len(assignments))
+	for i, assignment := range assignments {
+		progress, err := assignmentProgress(ctx, assignment, "")
+		if err != nil {
+			return nil, err
+		}
+		stats[i] = assignmentStats(assignment, progress)
+	}
+	return stats, nil
+}
+
+// assignmentID reads the :id path parameter
+func assignmentID(c *gin.Context) (uint, error) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 0)
+	if err != nil {
+		return 0, invalidParam("id", "uint", nil)
+	}
+	return uint(id), nil
+}
+
+// ListAssignments godoc
+// @Summary List my assignments
+// @Tags assignments
+// @x-v1 true
+// @x-v2 true
+// @Description The opened assignments of the course, by due time, with the status of the logged-in player. Scores count towards an assignment when they were submitted after it opened with its difficulty and seed. Requires JWT authentication.
+// @Produce json
+// @Param Authorization header string false "Bearer Token, alternative to the Authorization cookie" format("Bearer <token>")
+// @Success 200 {array} PlayerAssignment
+// @Failure 401 {object} Problem "Unauthorized or missing token"
+// @Failure 500 {object} Problem "Internal server error"
+// @Failure 503 {object} Problem "Database is unavailable"
+// @Router /assignments [get]
+func ListAssignments(c *gin.Context) {
+	claims, ok := authenticate(c)
+	if !ok {
+		return
+	}
+
+	assignments, err := PlayerAssignments(c.Request.Context(), claims.Login)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, assignments)
+}
+
+// ListAssignmentStats godoc
+// @Summary Assignment completion stats
+// @Tags admin
+// @x-v1 true
+// @x-v2 true
+// @Description Every assignment of the course, including the ones not opened yet, with the number of students per status. Requires an admin JWT.
+// @Produce json
+// @Success 200 {array} AssignmentStats
+// @Failure 401 {object} Problem "Unauthorized or missing token"
+// @Failure 403 {object} Problem "Admin access required"
+// @Failure 500 {object} Problem "Internal server error"
+// @Failure 503 {object} Problem "Database is unavailable"
+// @Router /admin/assignments [get]
+func ListAssignmentStats(c *gin.Context) {
+	stats, err := AllAssignmentStats(c.Request.Context())
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, stats)
+}
+
+// GetAssignmentProgress godoc
+// @Summary Progress of every student on an assignment
+// @Tags admin
+// @x-v1 true
+// @x-v2 true
+// @Description Requires an admin JWT.
+// @Produce json
+// @Param id path int true "Assignment ID"
+// @Success 200 {array} AssignmentProgress
+// @Failure 400 {object} Problem "Invalid ID"
+// @Failure 401 {object} Problem "Unauthorized or missing token"
+// @Failure 403 {object} Problem "Admin access required"
+// @Failure 404 {object} Problem "No such assignment"
+// @Failure 500 {object} Problem "Internal server error"
+// @Failure 503 {object} Problem "Database is unavailable"
+// @Router /admin/assignments/{id} [get]
+func GetAssignmentProgress(c *gin.Context) {
+	id, err := assignmentID(c)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	assignment, err := GetAssignment(c.Request.Context(), id)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	progress, err := assignmentProgress(c.Request.Context(), assignment, "")
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, progress)
+}
+
+// AddAssignment godoc
+// @Summary Create an assignment
+// @Tags admin
+// @x-v1 true
+// @x-v2 true
+// @Description Asks students for a target score on a difficulty, a seed or both, between the opening and the due time. Requires an admin JWT.
+// @Accept json
+// @Produce json
+// @Param body body AssignmentRequest true "Assignment, times in RFC3339"
+// @Success 201 {object} Assignment
+// @Failure 400 {object} Problem "Invalid input"
+// @Failure 401 {object} Problem "Unauthorized or missing token"
+// @Failure 403 {object} Problem "Admin access required"
+// @Failure 500 {object} Problem "Internal server error"
+// @Failure 503 {object} Problem "Database is unavailable"
+// @Router /admin/assignments [post]
+func AddAssignment(c *gin.Context) {
+	var json AssignmentRequest
+
+	if err := c.ShouldBindJSON(&json); err != nil {
+		respondError(c, bindingError(err))
+		return
+	}
+
+	assignment, err := CreateAssignment(c.Request.Context(), json)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	audit(c, AuditAdminAssignmentCreate, "", strconv.FormatUint(uint64(assignment.ID), 10)+" "+assignment.Title)
+
+	c.IndentedJSON(http.StatusCreated, assignment)
+}
+
+// RemoveAssignment godoc
+// @Summary Delete an assignment
+// @Tags admin
+// @x-v1 true
+// @x-v2 true
+// @Description The scores submitted for it stay. Requires an admin JWT.
+// @Produce json
+// @Param id path int true "Assignment ID"
+// @Success 200 {object} map[string]string "Assignment deleted"
+// @Failure 400 {object} Problem "Invalid ID"
+// @Failure 401 {object} Problem "Unauthorized or missing token"
+// @Failure 403 {object} Problem "Admin access required"
+// @Failure 404 {object} Problem "No such assignment"
+// @Failure 500 {object} Problem "Internal server error"
+// @Failure 503 {object} Problem "Database is unavailable"
+// @Router /admin/assignments/{id} [delete]
+func RemoveAssignment(c *gin.Context) {
+	id, err := assignmentID(c)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	if err := DeleteAssignment(c.Request.Context(), id); err != nil {
+		respondError(c, err)
+		return
+	}
+
+	audit(c, AuditAdminAssignmentDelete, "", c.Param("id"))
+
+	c.IndentedJSON(http.StatusOK, gin.H{"message": message(c, "assignment_deleted")})
+}
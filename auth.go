@@ -2,16 +2,24 @@ package main
 
 import (
 	"errors"
+	"github.com/gin-gonic/gin"
 	"github.com/golang-jwt/jwt/v5"
-	"os"
+	"net/http"
 	"regexp"
+	"strings"
 	"time"
 )
 
-var jwtSecret = []byte(os.Getenv("JWT_SECRET")) // Replace with a strong secret
+// set from the configuration at startup
+var (
+	jwtSecret   []byte
+	tokenExpiry time.Duration
+)
 
 type JWTClaims struct {
 	Login string `json:"login"`
+	// Course is the namespace of the course the token was issued for, empty for the default course
+	Course string `json:"course,omitempty"`
 	jwt.RegisteredClaims
 }
 
@@ -29,16 +37,90 @@ func VerifyToken(tokenString string) (*JWTClaims, error) {
 	return claims, nil
 }
 
-// GenerateJWT generates a JWT token for a given user
-func GenerateJWT(login string, tokenExpiry time.Duration) (string, error) {
+// GenerateJWT generates a JWT token for a given user of course bound to the session with sessionID
+func GenerateJWT(login, course, sessionID string, tokenExpiry time.Duration) (string, error) {
 	claims := jwt.MapClaims{
 		"login": login,
+		"jti":   sessionID,
 		"exp":   time.Now().Add(tokenExpiry).Unix(),
 	}
+	if course != "" {
+		claims["course"] = course
+	}
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
 	return token.SignedString(jwtSecret)
 }
 
+// bearerToken returns the token of an "Authorization: Bearer <token>" header
+func bearerToken(c *gin.Context) (string, bool) {
+	token, found := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+	return token, found && token != ""
+}
+
+// requestToken prefers the Authorization header and falls back to the Authorization cookie,
+// unless the route only accepts bearer tokens
+func requestToken(c *gin.Context) (string, error) {
+	if token, ok := bearerToken(c); ok {
+		return token, nil
+	}
+	if c.GetBool("bearerOnly") {
+		return "", http.ErrNoCookie
+	}
+	return c.Cookie("Authorization")
+}
+
+// authenticate verifies the bearer token or the Authorization cookie and stores the claims in the context.
+// On failure the response is already written and the caller must return
+func authenticate(c *gin.Context) (*JWTClaims, bool) {
+	tokenString, err := requestToken(c)
+	if err != nil {
+		respondError(c, ErrMissingToken)
+		return nil, false
+	}
+
+	claims, err := VerifyToken(tokenString)
+	// a token is only good for the course it was issued in
+	if err != nil || claims.Course != courseFrom(c.Request.Context()).namespace() {
+		respondError(c, ErrInvalidToken)
+		return nil, false
+	}
+
+	active, err := IsSessionActive(c.Request.Context(), claims.ID, claims.Login)
+	if err != nil {
+		respondError(c, err)
+		return nil, false
+	}
+	if !active {
+		respondError(c, ErrSessionRevoked)
+		return nil, false
+	}
+
+	c.Set("claims", claims)
+	return claims, true
+}
+
+// AdminOnly lets through only logged-in players flagged as admins (instructors)
+func AdminOnly() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims, ok := authenticate(c)
+		if !ok {
+			return
+		}
+
+		player, err := GetPlayerByLogin(c.Request.Context(), claims.Login)
+		if err != nil && !errors.As(err, &ErrNoSuchPlayer) {
+			respondError(c, err)
+			return
+		}
+		if err != nil || !player.IsAdmin {
+			respondError(c, ErrAdminRequired)
+			return
+		}
+
+		c.Next()
+	}
+}
+
 func IsValidSHA256Hash(s string) bool {
 	if len(s) != 64 {
 		return false
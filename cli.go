@@ -0,0 +1,394 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// runCommand executes a maintenance subcommand instead of starting the API and returns the exit code
+func runCommand(cfg Config, args []string) int {
+	switch {
+	case len(args) >= 2 && args[0] == "audit" && args[1] == "export":
+		return auditExportCommand(args[2:])
+	case len(args) >= 2 && args[0] == "audit" && args[1] == "verify":
+		return auditVerifyCommand()
+	case len(args) >= 2 && args[0] == "migrate" && args[1] == "up":
+		return migrateUpCommand()
+	case len(args) >= 2 && args[0] == "migrate" && args[1] == "down":
+		return migrateDownCommand(args[2:])
+	case len(args) >= 2 && args[0] == "migrate" && args[1] == "status":
+		return migrateStatusCommand()
+	case len(args) >= 2 && args[0] == "roster" && args[1] == "sync":
+		return rosterSyncCommand(cfg.Users)
+	case len(args) >= 2 && args[0] == "roster" && args[1] == "import":
+		return rosterImportCommand(cfg.Users, args[2:])
+	case len(args) >= 1 && args[0] == "grades":
+		return gradesCommand(args[1:])
+	case len(args) >= 2 && args[0] == "course" && args[1] == "create":
+		return courseCreateCommand(args[2:])
+	case len(args) >= 2 && args[0] == "course" && args[1] == "list":
+		return courseListCommand()
+	case len(args) >= 2 && args[0] == "course" && args[1] == "admin":
+		return courseAdminCommand(args[2:])
+	}
+
+	fmt.Fprintln(os.Stderr, "usage:")
+	fmt.Fprintln(os.Stderr, "  main audit export [-o file] [-course slug] [-event e] [-login l] [-since t] [-until t]")
+	fmt.Fprintln(os.Stderr, "  main audit verify")
+	fmt.Fprintln(os.Stderr, "  main migrate up")
+	fmt.Fprintln(os.Stderr, "  main migrate down [-steps n]")
+	fmt.Fprintln(os.Stderr, "  main migrate status")
+	fmt.Fprintln(os.Stderr, "  main roster sync")
+	fmt.Fprintln(os.Stderr, "  main roster import [-course slug] [-format csv|json] file")
+	fmt.Fprintln(os.Stderr, "  main grades -deadline t [-course slug] [-format csv|xlsx] [-o file]")
+	fmt.Fprintln(os.Stderr, "  main course create [-name n] [-directory bot|roster|open] slug")
+	fmt.Fprintln(os.Stderr, "  main course list")
+	fmt.Fprintln(os.Stderr, "  main course admin slug login")
+	return 2
+}
+
+// auditExportCommand writes the filtered audit log as JSON lines, oldest entry first
+func auditExportCommand(args []string) int {
+	fs := flag.NewFlagSet("audit export", flag.ContinueOnError)
+	output := fs.String("o", "", "output file (default stdout)")
+	course := fs.String("course", "", "only entries of this course (default every course)")
+	event := fs.String("event", "", "only entries of this event type")
+	login := fs.String("login", "", "only entries about this player")
+	since := fs.String("since", "", "RFC3339 lower bound (inclusive)")
+	until := fs.String("until", "", "RFC3339 upper bound (exclusive)")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	filter := AuditFilter{Event: *event, Login: *login, AllCourses: *course == ""}
+
+	ctx, err := courseContext(*course)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	if *since != "" {
+		if filter.Since, err = time.Parse(time.RFC3339, *since); err != nil {
+			fmt.Fprintln(os.Stderr, "since must be an RFC3339 timestamp")
+			return 2
+		}
+	}
+	if *until != "" {
+		if filter.Until, err = time.Parse(time.RFC3339, *until); err != nil {
+			fmt.Fprintln(os.Stderr, "until must be an RFC3339 timestamp")
+			return 2
+		}
+	}
+
+	entries, err := GetAuditEntries(ctx, filter)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	var out io.Writer = os.Stdout
+	if *output != "" {
+		file, err := os.Create(*output)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		defer file.Close()
+		out = file
+	}
+
+	encoder := json.NewEncoder(out)
+	for i := len(entries) - 1; i >= 0; i-- {
+		if err := encoder.Encode(entries[i]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "exported %d audit entries\n", len(entries))
+	return auditVerifyCommand()
+}
+
+func auditVerifyCommand() int {
+	verified, err := VerifyAuditChain(context.Background())
+	if err != nil {
+		if errors.As(err, &ErrAuditTampered) {
+			fmt.Fprintf(os.Stderr, "TAMPERED: %v (%d entries verified before it)\n", err, verified)
+			return 3
+		}
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	fmt.Fprintf(os.Stderr, "audit chain intact: %d entries verified\n", verified)
+	return 0
+}
+
+func migrateUpCommand() int {
+	applied, err := MigrateUp(context.Background(), GameDB)
+	for _, migration := range applied {
+		fmt.Fprintf(os.Stderr, "applied %04d_%s\n", migration.Version, migration.Name)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	if len(applied) == 0 {
+		fmt.Fprintln(os.Stderr, "schema is up to date")
+	}
+	return 0
+}
+
+func migrateDownCommand(args []string) int {
+	fs := flag.NewFlagSet("migrate down", flag.ContinueOnError)
+	steps := fs.Int("steps", 1, "number of migrations to revert")
+	if err := fs.Parse(args); err != nil || *steps < 1 {
+		return 2
+	}
+
+	reverted, err := MigrateDown(context.Background(), GameDB, *steps)
+	for _, migration := range reverted {
+		fmt.Fprintf(os.Stderr, "reverted %04d_%s\n", migration.Version, migration.Name)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	if len(reverted) == 0 {
+		fmt.Fprintln(os.Stderr, "nothing to revert")
+	}
+	return 0
+}
+
+// migrateStatusCommand prints one line per migration to stdout
+func migrateStatusCommand() int {
+	states, err := MigrationStatus(context.Background(), GameDB)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	for _, state := range states {
+		applied := "pending"
+		if state.AppliedAt != nil {
+			applied = "applied " + state.AppliedAt.UTC().Format(time.RFC3339)
+		}
+		fmt.Printf("%04d_%s\t%s\n", state.Version, state.Name, applied)
+	}
+	return 0
+}
+
+// rosterSyncCommand copies the bot's users into the roster of every course using the bot once, as the sync job would
+func rosterSyncCommand(cfg UsersConfig) int {
+	courses, err := FindCourses(context.Background())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	status := 0
+	for _, course := range courses {
+		if course.directory() != "bot" {
+			continue
+		}
+
+		ctx := withCourse(context.Background(), course)
+		changes, err := SyncRoster(ctx, NewBotUserDirectory(UsersDB), cfg.DeactivateRemoved, rosterActor)
+		fmt.Fprintf(os.Stderr, "%s: added %d, renamed %d, removed %d, restored %d\n",
+			course.Slug, changes.Added, changes.Renamed, changes.Removed, changes.Restored)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			status = 1
+		}
+	}
+	return status
+}
+
+// rosterImportCommand replaces the roster with a CSV or JSON file, like an upload to /admin/roster
+func rosterImportCommand(cfg UsersConfig, args []string) int {
+	fs := flag.NewFlagSet("roster import", flag.ContinueOnError)
+	format := fs.String("format", "", "csv or json (default from the file extension)")
+	course := fs.String("course", "", "course slug (default the default course)")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 1 {
+		return 2
+	}
+
+	ctx, err := courseContext(*course)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	file, err := os.Open(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer file.Close()
+
+	if *format == "" {
+		*format = rosterFormat("", file.Name())
+	}
+
+	users, err := ParseRoster(io.LimitReader(file, maxRosterSize), *format)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	changes, err := ImportRoster(ctx, users, cfg.DeactivateRemoved, "cli")
+	fmt.Fprintf(os.Stderr, "%d entries: added %d, renamed %d, removed %d, restored %d\n",
+		len(users), changes.Added, changes.Renamed, changes.Removed, changes.Restored)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// gradesCommand writes the grade sheet of a course at a deadline, like /admin/grades
+func gradesCommand(args []string) int {
+	fs := flag.NewFlagSet("grades", flag.ContinueOnError)
+	deadline := fs.String("deadline", "", "RFC3339 timestamp, scores after it do not count")
+	course := fs.String("course", "", "course slug (default the default course)")
+	format := fs.String("format", "", "csv or xlsx (default from the output file extension, else csv)")
+	output := fs.String("o", "", "output file (default stdout)")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	at, err := time.Parse(time.RFC3339, *deadline)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "deadline must be an RFC3339 timestamp")
+		return 2
+	}
+	if *format == "" {
+		*format = "csv"
+		if strings.HasSuffix(strings.ToLower(*output), ".xlsx") {
+			*format = "xlsx"
+		}
+	}
+	if *format != "csv" && *format != "xlsx" {
+		fmt.Fprintln(os.Stderr, "format must be csv or xlsx")
+		return 2
+	}
+
+	ctx, err := courseContext(*course)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	rows, err := GradeSheet(ctx, at)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	var out io.Writer = os.Stdout
+	if *output != "" {
+		file, err := os.Create(*output)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		defer file.Close()
+		out = file
+	}
+
+	if err := writeGrades(out, rows, *format); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	fmt.Fprintf(os.Stderr, "graded %d students\n", len(rows))
+	return 0
+}
+
+// courseContext works on the course with the slug, empty means the default course
+func courseContext(slug string) (context.Context, error) {
+	if slug == "" {
+		return context.Background(), nil
+	}
+
+	course, err := GetCourse(context.Background(), slug)
+	if err != nil {
+		return nil, fmt.Errorf("course %s: %w", slug, err)
+	}
+	return withCourse(context.Background(), course), nil
+}
+
+func courseCreateCommand(args []string) int {
+	fs := flag.NewFlagSet("course create", flag.ContinueOnError)
+	name := fs.String("name", "", "display name (default the slug)")
+	directory := fs.String("directory", "", "bot, roster or open (default users.directory)")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 1 {
+		return 2
+	}
+	if *directory != "" && *directory != "bot" && *directory != "roster" && *directory != "open" {
+		fmt.Fprintln(os.Stderr, "directory must be one of bot, roster, open")
+		return 2
+	}
+	if *name == "" {
+		*name = fs.Arg(0)
+	}
+
+	course, err := CreateCourse(context.Background(), fs.Arg(0), *name, *directory)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	fmt.Fprintf(os.Stderr, "created course %s (%s directory)\n", course.Slug, course.directory())
+	return 0
+}
+
+// courseListCommand prints one line per course to stdout
+func courseListCommand() int {
+	courses, err := FindCourses(context.Background())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	for _, course := range courses {
+		fmt.Printf("%s\t%s\t%s\n", course.Slug, course.directory(), course.Name)
+	}
+	return 0
+}
+
+// courseAdminCommand makes a player of the course its instructor. Admins of one course have no rights in another
+func courseAdminCommand(args []string) int {
+	if len(args) != 2 {
+		return 2
+	}
+
+	ctx, err := courseContext(args[0])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	result := GameDB.WithContext(ctx).Model(&Player{}).Scopes(inCourse).Where("login = ?", args[1]).Update("is_admin", true)
+	if result.Error != nil {
+		fmt.Fprintln(os.Stderr, result.Error)
+		return 1
+	}
+	if result.RowsAffected == 0 {
+		fmt.Fprintln(os.Stderr, &NoSuchPlayerError{args[1]})
+		return 1
+	}
+
+	fmt.Fprintf(os.Stderr, "%s is now an admin of %s\n", args[1], args[0])
+	return 0
+}
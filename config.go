@@ -0,0 +1,429 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/joho/godotenv"
+	"gopkg.in/yaml.v3"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config is everything the server can be told at startup. Sources override each other in this order:
+// defaults, the YAML file, .env, the environment, command-line flags
+type Config struct {
+	Port         int           `yaml:"port"`
+	AllowedHosts []string      `yaml:"allowed_hosts"`
+	JWTSecret    string        `yaml:"jwt_secret"`
+	TokenExpiry  time.Duration `yaml:"token_expiry"`
+	LegacySunset string        `yaml:"legacy_sunset"` // YYYY-MM-DD
+	// CourseDomain lets <course>.<domain> select a course, besides the /courses/<course> path prefix
+	CourseDomain string `yaml:"course_domain"`
+
+	// LoginAttemptStore keeps the login guard's counters in memory or in the database (shared between instances)
+	LoginAttemptStore string `yaml:"login_attempt_store"`
+
+	Server ServerConfig `yaml:"server"`
+	// DB holds the game data and is migrated by this API. When only one of DB and UsersDB has a host,
+	// both use that database, as deployments did before the two were split
+	DB DBConfig `yaml:"db"`
+	// UsersDB is the Telegram bot's database, only ever read for the course users
+	UsersDB DBConfig     `yaml:"users_db"`
+	Users   UsersConfig  `yaml:"users"`
+	Grades  GradesConfig `yaml:"grades"`
+
+	RateLimit RateLimitConfig `yaml:"rate_limit"`
+	Log       LogConfig       `yaml:"log"`
+	Metrics   MetricsConfig   `yaml:"metrics"`
+	Tracing   TracingConfig   `yaml:"tracing"`
+}
+
+type ServerConfig struct {
+	ReadTimeout     time.Duration `yaml:"read_timeout"`
+	WriteTimeout    time.Duration `yaml:"write_timeout"`
+	IdleTimeout     time.Duration `yaml:"idle_timeout"`
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"` // how long in-flight requests and workers get to finish
+}
+
+type DBConfig struct {
+	Host     string `yaml:"host"`
+	Port     int    `yaml:"port"`
+	Name     string `yaml:"name"`
+	User     string `yaml:"user"`
+	Password string `yaml:"password"`
+	SSLMode  string `yaml:"sslmode"`
+	TimeZone string `yaml:"timezone"`
+
+	// MigrateOnStart applies pending migrations at boot instead of refusing to start
+	MigrateOnStart bool `yaml:"migrate_on_start"`
+}
+
+type UsersConfig struct {
+	// Directory decides who may register: "bot" for the bot's users table, "roster" for a roster
+	// uploaded by an instructor, "open" for anyone
+	Directory string `yaml:"directory"`
+	// CacheTTL is how long a looked up user is trusted before asking the users database again.
+	// Cached users keep answering while that database is down. 0 turns the cache off
+	CacheTTL time.Duration `yaml:"cache_ttl"`
+	// SyncInterval is how often the bot's users are copied into the local roster. Users are then
+	// looked up in the roster and the cache is not used. 0 turns the sync off
+	SyncInterval time.Duration `yaml:"sync_interval"`
+	// DeactivateRemoved stops students who left the course, or the uploaded roster, from logging in
+	DeactivateRemoved bool `yaml:"deactivate_removed"`
+}
+
+type GradesConfig struct {
+	// Thresholds map the best score before a deadline to a grade, a score gets the grade of the
+	// highest threshold it reaches and none below the lowest
+	Thresholds []GradeThreshold `yaml:"thresholds"`
+}
+
+type RateLimitConfig struct {
+	Store string `yaml:"store"` // memory or db
+	Key   string `yaml:"key"`   // ip or login, anonymous endpoints always use ip
+	Auth  string `yaml:"auth"`
+	Score string `yaml:"score"`
+	Read  string `yaml:"read"`
+	Admin string `yaml:"admin"`
+}
+
+type LogConfig struct {
+	Level  string `yaml:"level"`
+	Format string `yaml:"format"`
+}
+
+type MetricsConfig struct {
+	Addr  string `yaml:"addr"`
+	Token string `yaml:"token"`
+}
+
+type TracingConfig struct {
+	Exporter string `yaml:"exporter"`
+}
+
+func defaultConfig() Config {
+	return Config{
+		Port:              8080,
+		TokenExpiry:       time.Hour,
+		LegacySunset:      defaultLegacySunset,
+		LoginAttemptStore: "memory",
+		Server: ServerConfig{
+			ReadTimeout:     15 * time.Second,
+			WriteTimeout:    30 * time.Second,
+			IdleTimeout:     60 * time.Second,
+			ShutdownTimeout: 20 * time.Second,
+		},
+		DB: DBConfig{
+			Port:     5432,
+			SSLMode:  "require",
+			TimeZone: "Europe/Moscow",
+		},
+		UsersDB: DBConfig{
+			Port:     5432,
+			SSLMode:  "require",
+			TimeZone: "Europe/Moscow",
+		},
+		Users: UsersConfig{Directory: "bot", CacheTTL: 5 * time.Minute},
+		RateLimit: RateLimitConfig{
+			Store: "memory",
+			Key:   "ip",
+			Auth:  "10/1m",
+			Score: "60/1m",
+			Read:  "300/1m",
+			Admin: "30/1m",
+		},
+		Log:     LogConfig{Level: "info", Format: "json"},
+		Tracing: TracingConfig{Exporter: "none"},
+	}
+}
+
+// DSN is the connection string for the postgres driver
+func (c DBConfig) DSN() string {
+	return fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=%s TimeZone=%s",
+		c.Host, c.Port, c.User, c.Password, c.Name, c.SSLMode, c.TimeZone)
+}
+
+// plainConfig has no LogValue method, so logging it does not recurse
+type plainConfig Config
+
+// LogValue keeps secrets out of the startup log
+func (c Config) LogValue() slog.Value {
+	c.JWTSecret = redacted
+	c.DB.Password = redacted
+	c.UsersDB.Password = redacted
+	if c.Metrics.Token != "" {
+		c.Metrics.Token = redacted
+	}
+	return slog.AnyValue(plainConfig(c))
+}
+
+// loadConfig reads the configuration and returns the arguments left after the flags, which name a CLI command
+func loadConfig(args []string) (Config, []string, error) {
+	cfg := defaultConfig()
+
+	flags := flag.NewFlagSet("memoryGameAPI", flag.ContinueOnError)
+	configFile := flags.String("config", os.Getenv("CONFIG_FILE"), "YAML configuration file")
+	envFile := flags.String("env-file", ".env", "dotenv file, skipped when it does not exist")
+	port := flags.Int("port", 0, "HTTP port")
+	dbHost := flags.String("db-host", "", "game database host")
+	dbPort := flags.Int("db-port", 0, "game database port")
+	dbName := flags.String("db-name", "", "game database name")
+	dbSSLMode := flags.String("db-sslmode", "", "game database sslmode")
+	dbTimeZone := flags.String("db-timezone", "", "game database session time zone")
+	logLevel := flags.String("log-level", "", "debug, info, warn or error")
+	if err := flags.Parse(args); err != nil {
+		return cfg, nil, err
+	}
+
+	if *configFile != "" {
+		if err := cfg.loadYAML(*configFile); err != nil {
+			return cfg, nil, err
+		}
+	}
+
+	if err := godotenv.Load(*envFile); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return cfg, nil, fmt.Errorf("%s: %w", *envFile, err)
+	}
+
+	envErr := cfg.loadEnv()
+
+	// only flags given on the command line override, their zero defaults must not
+	flags.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "port":
+			cfg.Port = *port
+		case "db-host":
+			cfg.DB.Host = *dbHost
+		case "db-port":
+			cfg.DB.Port = *dbPort
+		case "db-name":
+			cfg.DB.Name = *dbName
+		case "db-sslmode":
+			cfg.DB.SSLMode = *dbSSLMode
+		case "db-timezone":
+			cfg.DB.TimeZone = *dbTimeZone
+		case "log-level":
+			cfg.Log.Level = *logLevel
+		}
+	})
+
+	// a single database still serves both, whichever of the two was configured
+	switch {
+	case cfg.DB.Host == "":
+		migrate := cfg.DB.MigrateOnStart
+		cfg.DB = cfg.UsersDB
+		cfg.DB.MigrateOnStart = migrate
+	case cfg.UsersDB.Host == "":
+		cfg.UsersDB = cfg.DB
+		cfg.UsersDB.MigrateOnStart = false
+	}
+
+	return cfg, flags.Args(), errors.Join(envErr, cfg.validate())
+}
+
+func (c *Config) loadYAML(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	decoder := yaml.NewDecoder(file)
+	decoder.KnownFields(true) // a typo in a key should not silently fall back to the default
+	if err := decoder.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
+
+func (c *Config) loadEnv() error {
+	var errs []error
+
+	envString := func(name string, target *string) {
+		if value, ok := os.LookupEnv(name); ok {
+			*target = value
+		}
+	}
+	envInt := func(name string, target *int) {
+		if value, ok := os.LookupEnv(name); ok {
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s must be an integer, got %q", name, value))
+				return
+			}
+			*target = n
+		}
+	}
+
+	envDuration := func(name string, target *time.Duration) {
+		if value, ok := os.LookupEnv(name); ok {
+			d, err := time.ParseDuration(value)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s must be a duration like 30s, got %q", name, value))
+				return
+			}
+			*target = d
+		}
+	}
+
+	envInt("PORT", &c.Port)
+	if value, ok := os.LookupEnv("ALLOWED_HOSTS"); ok {
+		c.AllowedHosts = strings.Split(value, ",")
+	}
+	envString("JWT_SECRET", &c.JWTSecret)
+	if value, ok := os.LookupEnv("EXPIRATION_TIME"); ok {
+		minutes, err := strconv.Atoi(value)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("EXPIRATION_TIME must be a number of minutes, got %q", value))
+		} else {
+			c.TokenExpiry = time.Duration(minutes) * time.Minute
+		}
+	}
+	envString("LEGACY_SUNSET", &c.LegacySunset)
+	envString("COURSE_DOMAIN", &c.CourseDomain)
+	envString("LOGIN_ATTEMPT_STORE", &c.LoginAttemptStore)
+
+	envDuration("HTTP_READ_TIMEOUT", &c.Server.ReadTimeout)
+	envDuration("HTTP_WRITE_TIMEOUT", &c.Server.WriteTimeout)
+	envDuration("HTTP_IDLE_TIMEOUT", &c.Server.IdleTimeout)
+	envDuration("SHUTDOWN_TIMEOUT", &c.Server.ShutdownTimeout)
+
+	envString("GAME_DB_HOST", &c.DB.Host)
+	envInt("GAME_DB_PORT", &c.DB.Port)
+	envString("GAME_DB_NAME", &c.DB.Name)
+	envString("GAME_DB_USER", &c.DB.User)
+	envString("GAME_DB_PASS", &c.DB.Password)
+	envString("GAME_DB_SSLMODE", &c.DB.SSLMode)
+	envString("GAME_DB_TIMEZONE", &c.DB.TimeZone)
+	if value, ok := os.LookupEnv("GAME_DB_MIGRATE_ON_START"); ok {
+		migrate, err := strconv.ParseBool(value)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("GAME_DB_MIGRATE_ON_START must be true or false, got %q", value))
+		} else {
+			c.DB.MigrateOnStart = migrate
+		}
+	}
+
+	envString("BOT_DB_HOST", &c.UsersDB.Host)
+	envInt("BOT_DB_PORT", &c.UsersDB.Port)
+	envString("BOT_DB_NAME", &c.UsersDB.Name)
+	envString("BOT_DB_USER", &c.UsersDB.User)
+	envString("BOT_DB_PASS", &c.UsersDB.Password)
+	envString("BOT_DB_SSLMODE", &c.UsersDB.SSLMode)
+	envString("BOT_DB_TIMEZONE", &c.UsersDB.TimeZone)
+	envString("USERS_DIRECTORY", &c.Users.Directory)
+	envDuration("USERS_CACHE_TTL", &c.Users.CacheTTL)
+	envDuration("USERS_SYNC_INTERVAL", &c.Users.SyncInterval)
+	if value, ok := os.LookupEnv("USERS_DEACTIVATE_REMOVED"); ok {
+		deactivate, err := strconv.ParseBool(value)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("USERS_DEACTIVATE_REMOVED must be true or false, got %q", value))
+		} else {
+			c.Users.DeactivateRemoved = deactivate
+		}
+	}
+
+	if value, ok := os.LookupEnv("GRADE_THRESHOLDS"); ok {
+		thresholds, err := ParseGradeThresholds(value)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("GRADE_THRESHOLDS: %w", err))
+		} else {
+			c.Grades.Thresholds = thresholds
+		}
+	}
+
+	envString("RATE_LIMIT_STORE", &c.RateLimit.Store)
+	envString("RATE_LIMIT_KEY", &c.RateLimit.Key)
+	envString("RATE_LIMIT_AUTH", &c.RateLimit.Auth)
+	envString("RATE_LIMIT_SCORE", &c.RateLimit.Score)
+	envString("RATE_LIMIT_READ", &c.RateLimit.Read)
+	envString("RATE_LIMIT_ADMIN", &c.RateLimit.Admin)
+
+	envString("LOG_LEVEL", &c.Log.Level)
+	envString("LOG_FORMAT", &c.Log.Format)
+	envString("METRICS_ADDR", &c.Metrics.Addr)
+	envString("METRICS_TOKEN", &c.Metrics.Token)
+	envString("OTEL_TRACES_EXPORTER", &c.Tracing.Exporter)
+
+	return errors.Join(errs...)
+}
+
+// validate reports every invalid value at once, so a broken deployment is fixed in one go
+func (c Config) validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+	oneOf := func(name, value string, allowed ...string) {
+		check(slices.Contains(allowed, value), "%s must be one of %s, got %q", name, strings.Join(allowed, ", "), value)
+	}
+
+	check(c.Port > 0 && c.Port < 65536, "port must be between 1 and 65535, got %d", c.Port)
+	check(c.JWTSecret != "", "jwt secret is required (JWT_SECRET)")
+	// the CORS middleware panics on these instead of saying what is wrong
+	check(len(c.AllowedHosts) > 0, "allowed hosts are required (ALLOWED_HOSTS)")
+	for _, origin := range c.AllowedHosts {
+		check(origin == "*" || strings.HasPrefix(origin, "http://") || strings.HasPrefix(origin, "https://"),
+			"allowed host %q must be * or start with http:// or https://", origin)
+	}
+	check(c.TokenExpiry > 0, "token expiry must be positive, got %s", c.TokenExpiry)
+	if _, err := time.Parse(time.DateOnly, c.LegacySunset); err != nil {
+		errs = append(errs, fmt.Errorf("legacy sunset must be YYYY-MM-DD, got %q", c.LegacySunset))
+	}
+	oneOf("login attempt store", c.LoginAttemptStore, "memory", "db")
+	check(c.Server.ReadTimeout > 0 && c.Server.WriteTimeout > 0 && c.Server.IdleTimeout > 0,
+		"http timeouts must be positive")
+	check(c.Server.ShutdownTimeout > 0, "shutdown timeout must be positive, got %s", c.Server.ShutdownTimeout)
+
+	for _, db := range []struct {
+		name, env string
+		cfg       DBConfig
+	}{{"game database", "GAME_DB", c.DB}, {"users database", "BOT_DB", c.UsersDB}} {
+		check(db.cfg.Host != "", "%s host is required (%s_HOST)", db.name, db.env)
+		check(db.cfg.Name != "", "%s name is required (%s_NAME)", db.name, db.env)
+		check(db.cfg.User != "", "%s user is required (%s_USER)", db.name, db.env)
+		check(db.cfg.Port > 0 && db.cfg.Port < 65536, "%s port must be between 1 and 65535, got %d", db.name, db.cfg.Port)
+		oneOf(db.name+" sslmode", db.cfg.SSLMode, "disable", "allow", "prefer", "require", "verify-ca", "verify-full")
+		if _, err := time.LoadLocation(db.cfg.TimeZone); err != nil {
+			errs = append(errs, fmt.Errorf("%s timezone: %w", db.name, err))
+		}
+	}
+	check(c.Users.CacheTTL >= 0, "users cache ttl must not be negative, got %s", c.Users.CacheTTL)
+	oneOf("users directory", c.Users.Directory, "bot", "roster", "open")
+	check(c.Users.SyncInterval >= 0, "users sync interval must not be negative, got %s", c.Users.SyncInterval)
+	check(c.Users.SyncInterval == 0 || c.Users.Directory == "bot",
+		"users sync interval only applies to the bot directory, the %s directory has nothing to sync from", c.Users.Directory)
+
+	scores := make(map[uint]bool, len(c.Grades.Thresholds))
+	for _, threshold := range c.Grades.Thresholds {
+		check(threshold.Grade != "", "grade threshold %d needs a grade", threshold.MinScore)
+		check(!scores[threshold.MinScore], "grade threshold %d is listed twice", threshold.MinScore)
+		scores[threshold.MinScore] = true
+	}
+
+	oneOf("rate limit store", c.RateLimit.Store, "memory", "db")
+	oneOf("rate limit key", c.RateLimit.Key, "ip", "login")
+	for name, value := range map[string]string{"auth": c.RateLimit.Auth, "score": c.RateLimit.Score, "read": c.RateLimit.Read, "admin": c.RateLimit.Admin} {
+		if _, err := ParseRateLimit(value); err != nil {
+			errs = append(errs, fmt.Errorf("%s rate limit: %w", name, err))
+		}
+	}
+
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(c.Log.Level)); err != nil {
+		errs = append(errs, fmt.Errorf("log level: %w", err))
+	}
+	oneOf("log format", c.Log.Format, "json", "text")
+	oneOf("tracing exporter", c.Tracing.Exporter, "stdout", "otlp", "none")
+
+	return errors.Join(errs...)
+}
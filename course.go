@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// defaultCourseID is the course every deployment starts with. It holds everything from before courses existed
+const defaultCourseID = 1
+
+// slugPattern keeps course and group slugs usable as a path segment and, for courses, as a subdomain
+var slugPattern = regexp.MustCompile(`^[a-z0-9](?:[a-z0-9-]{0,61}[a-z0-9])?$`)
+
+// defaultUserDirectory is users.directory, for courses that do not name their own
+var defaultUserDirectory = "bot"
+
+// Course is a tenant: its players, rosters and leaderboard are separate from every other course.
+// Its admins are the instructors of this course only
+type Course struct {
+	ID        uint      `gorm:"primarykey" json:"-"`
+	CreatedAt time.Time `json:"-"`
+	Slug      string    `gorm:"unique;not null" json:"slug"`
+	Name      string    `gorm:"not null" json:"name"`
+	// Directory is bot, roster or open, empty means users.directory
+	Directory string `gorm:"not null;default:''" json:"-"`
+}
+
+type courseKey struct{}
+
+var defaultCourse = Course{ID: defaultCourseID, Slug: "default"}
+
+func (c Course) directory() string {
+	if c.Directory == "" {
+		return defaultUserDirectory
+	}
+	return c.Directory
+}
+
+// namespace qualifies logins in keys shared by every course, like lockouts and token claims.
+// It is empty for the default course, so keys from before courses existed stay valid
+func (c Course) namespace() string {
+	if c.ID == defaultCourseID {
+		return ""
+	}
+	return c.Slug
+}
+
+func withCourse(ctx context.Context, course Course) context.Context {
+	return context.WithValue(ctx, courseKey{}, course)
+}
+
+// courseFrom returns the course a request or job works on. Code running outside of one,
+// like CLI commands, works on the default course
+func courseFrom(ctx context.Context) Course {
+	if course, ok := ctx.Value(courseKey{}).(Course); ok {
+		return course
+	}
+	return defaultCourse
+}
+
+// inCourse is a gorm scope limiting a query to the course of its context
+func inCourse(db *gorm.DB) *gorm.DB {
+	return db.Where("course_id = ?", courseFrom(db.Statement.Context).ID)
+}
+
+func GetCourse(ctx context.Context, slug string) (Course, error) {
+	var course Course
+	result := GameDB.WithContext(ctx).Where("slug = ?", slug).First(&course)
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return course, ErrCourseNotFound
+	}
+	return course, result.Error
+}
+
+func courseByID(ctx context.Context, id uint) (Course, error) {
+	var course Course
+	result := GameDB.WithContext(ctx).First(&course, id)
+	return course, result.Error
+}
+
+func FindCourses(ctx context.Context) ([]Course, error) {
+	var courses []Course
+	result := GameDB.WithContext(ctx).Order("slug").Find(&courses)
+	return courses, result.Error
+}
+
+func CreateCourse(ctx context.Context, slug, name, directory string) (Course, error) {
+	if !slugPattern.MatchString(slug) {
+		return Course{}, invalidParam("slug", "invalid", nil)
+	}
+
+	course := Course{Slug: slug, Name: name, Directory: directory}
+	result := GameDB.WithContext(ctx).Create(&course)
+	return course, result.Error
+}
+
+// courseFromHost reads the course out of a subdomain of domain, e.g. os.game.example.org
+func courseFromHost(host, domain string) string {
+	if domain == "" {
+		return ""
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	slug, found := strings.CutSuffix(strings.ToLower(host), "."+strings.ToLower(domain))
+	if !found || strings.Contains(slug, ".") {
+		return ""
+	}
+	return slug
+}
+
+// CourseScope selects the course of the request by the :course path segment, then by the subdomain
+// of domain, and falls back to the default course
+func CourseScope(domain string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		slug := c.Param("course")
+		if slug == "" {
+			slug = courseFromHost(c.Request.Host, domain)
+		}
+
+		course := defaultCourse
+		if slug != "" {
+			var err error
+			if course, err = GetCourse(c.Request.Context(), slug); err != nil {
+				respondError(c, err)
+				return
+			}
+		}
+
+		c.Set("course", course)
+		c.Request = c.Request.WithContext(withCourse(c.Request.Context(), course))
+		c.Next()
+	}
+}
+
+// ListCourses godoc
+// @Summary List courses
+// @Tags courses
+// @x-v1 true
+// @x-v2 true
+// @Description Every course of this deployment. A course is selected with the /courses/{slug} path prefix or its subdomain, requests without either go to the default course.
+// @Produce json
+// @Success 200 {array} Course
+// @Failure 500 {object} Problem
+// @Failure 503 {object} Problem "Database is unavailable"
+// @Router /courses [get]
+func ListCourses(c *gin.Context) {
+	courses, err := FindCourses(c.Request.Context())
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, courses)
+}
@@ -1,10 +1,12 @@
 package main
 
 import (
-	"fmt"
+	"errors"
+	"github.com/jackc/pgx/v5/pgconn"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
 	"log"
+	"time"
 )
 
 type User struct {
@@ -16,24 +18,54 @@ type User struct {
 
 type Player struct {
 	gorm.Model `json:"-"`
-	Login      string `gorm:"unique;not null"`
+	CourseID   uint   `gorm:"not null" json:"-"`
+	Login      string `gorm:"not null"` // unique within the course
 	Password   string `gorm:"not null" json:"-"`
 	Score      uint   `gorm:"not null;default:0"`
+	IsAdmin    bool   `gorm:"not null;default:false" json:"-"`
+	Language   string `gorm:"not null;default:''" json:"-"`
+	// TgId links the player to their course user across username changes, unique within the course
+	TgId          *uint      `json:"-"`
+	DeactivatedAt *time.Time `json:"-"`
 }
 
-func initDB(host, dbName, dbUser, dbPass string, port int) *gorm.DB {
-	dsn := fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=require TimeZone=Europe/Moscow",
-		host, port, dbUser, dbPass, dbName)
+type ScoreRecord struct {
+	ID        uint      `gorm:"primarykey" json:"-"`
+	CreatedAt time.Time `gorm:"index"`
+	PlayerID  uint      `gorm:"not null;index" json:"-"`
+	Score     uint      `gorm:"not null"`
+	// Difficulty and Seed say what the score was played on, empty when the client did not tell
+	Difficulty string `gorm:"not null;default:''" json:",omitempty"`
+	Seed       string `gorm:"not null;default:''" json:",omitempty"`
+}
 
-	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{})
-	if err != nil {
-		log.Fatalf("Failed to connect to the database: %v", err)
-	}
+// initDB opens the game database, whose outages put the API into 503 mode
+func initDB(cfg DBConfig) *gorm.DB {
+	db := openDB("game", cfg.DSN(), &gorm.Config{})
+	registerHealthCallbacks(db)
+	return db
+}
 
-	err = db.AutoMigrate(&Player{})
+// initUsersDB opens the bot's database with read-only transactions. It is connected to lazily,
+// so the API starts and serves cached users while that database is down
+func initUsersDB(cfg DBConfig) *gorm.DB {
+	return openDB("users", cfg.DSN()+" default_transaction_read_only=on", &gorm.Config{DisableAutomaticPing: true})
+}
+
+func openDB(name, dsn string, config *gorm.Config) *gorm.DB {
+	db, err := gorm.Open(postgres.Open(dsn), config)
 	if err != nil {
-		log.Fatal("Failed to migrate database:", err)
+		log.Fatalf("Failed to connect to the %s database: %v", name, err)
 	}
 
+	registerMetricsCallbacks(db, name)
+	registerTracingCallbacks(db)
+
 	return db
 }
+
+// isUniqueViolation tells whether an insert lost a race against a unique index
+func isUniqueViolation(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "23505"
+}
@@ -1,21 +1,94 @@
 package main
 
 import (
-	"fmt"
+	"net/http"
+	"strconv"
 )
 
 var (
-	ErrPlayerExists = &PlayerExistsError{}
-	ErrNoSuchUser   = &NoSuchUserError{}
-	ErrNoSuchPlayer = &NoSuchPlayerError{}
+	ErrPlayerExists  = &PlayerExistsError{}
+	ErrNoSuchUser    = &NoSuchUserError{}
+	ErrNoSuchPlayer  = &NoSuchPlayerError{}
+	ErrAuditTampered = &AuditTamperedError{}
+	ErrWrongPassword = &WrongPasswordError{}
+	ErrValidation    = &ValidationError{}
 )
 
+// Request problems that need no dedicated type. Codes are part of the API contract, never change them
+var (
+	ErrUnhashedPassword     = &APIError{http.StatusBadRequest, "password_not_hashed"}
+	ErrInvalidCredentials   = &APIError{http.StatusBadRequest, "invalid_credentials"}
+	ErrMissingToken         = &APIError{http.StatusUnauthorized, "missing_token"}
+	ErrInvalidToken         = &APIError{http.StatusUnauthorized, "invalid_token"}
+	ErrSessionRevoked       = &APIError{http.StatusUnauthorized, "session_revoked"}
+	ErrForbidden            = &APIError{http.StatusForbidden, "forbidden"}
+	ErrAdminRequired        = &APIError{http.StatusForbidden, "admin_required"}
+	ErrInvalidCSRFToken     = &APIError{http.StatusForbidden, "csrf_token_invalid"}
+	ErrAccountDeactivated   = &APIError{http.StatusForbidden, "account_deactivated"}
+	ErrUserNotFound         = &APIError{http.StatusNotFound, "user_not_found"}
+	ErrCourseNotFound       = &APIError{http.StatusNotFound, "course_not_found"}
+	ErrGroupNotFound        = &APIError{http.StatusNotFound, "group_not_found"}
+	ErrAssignmentNotFound   = &APIError{http.StatusNotFound, "assignment_not_found"}
+	ErrNotInGroup           = &APIError{http.StatusNotFound, "not_in_group"}
+	ErrExportNotFound       = &APIError{http.StatusNotFound, "export_not_found"}
+	ErrExportNotReady       = &APIError{http.StatusConflict, "export_not_ready"}
+	ErrGroupExists          = &APIError{http.StatusConflict, "group_exists"}
+	ErrRosterEmpty          = &APIError{http.StatusBadRequest, "roster_empty"}
+	ErrRosterImportDisabled = &APIError{http.StatusConflict, "roster_import_disabled"}
+	ErrTooManyLoginAttempts = &APIError{http.StatusTooManyRequests, "too_many_login_attempts"}
+	ErrRateLimited          = &APIError{http.StatusTooManyRequests, "rate_limited"}
+	ErrInternal             = &APIError{http.StatusInternalServerError, "internal"}
+	ErrDBUnavailable        = &APIError{http.StatusServiceUnavailable, "db_unavailable"}
+)
+
+// CodedError is implemented by every error the API knows how to answer with.
+// The text of the error is the catalogue message of its code filled with its params
+type CodedError interface {
+	error
+	Code() string
+	Status() int
+	Params() map[string]string
+}
+
+type APIError struct {
+	status int
+	code   string
+}
+
+func (e *APIError) Error() string {
+	return translate(defaultLanguage, e.code, nil)
+}
+
+func (e *APIError) Code() string {
+	return e.code
+}
+
+func (e *APIError) Status() int {
+	return e.status
+}
+
+func (e *APIError) Params() map[string]string {
+	return nil
+}
+
 type PlayerExistsError struct {
 	Login string
 }
 
 func (e *PlayerExistsError) Error() string {
-	return fmt.Sprintf("player with login %s already exists", e.Login)
+	return translate(defaultLanguage, e.Code(), e.Params())
+}
+
+func (e *PlayerExistsError) Code() string {
+	return "player_exists"
+}
+
+func (e *PlayerExistsError) Status() int {
+	return http.StatusBadRequest
+}
+
+func (e *PlayerExistsError) Params() map[string]string {
+	return map[string]string{"login": e.Login}
 }
 
 type NoSuchUserError struct {
@@ -23,7 +96,40 @@ type NoSuchUserError struct {
 }
 
 func (e *NoSuchUserError) Error() string {
-	return fmt.Sprintf("cannot register player with login %s. No such user on course", e.Login)
+	return translate(defaultLanguage, e.Code(), e.Params())
+}
+
+func (e *NoSuchUserError) Code() string {
+	return "not_on_course"
+}
+
+func (e *NoSuchUserError) Status() int {
+	return http.StatusBadRequest
+}
+
+func (e *NoSuchUserError) Params() map[string]string {
+	return map[string]string{"login": e.Login}
+}
+
+// RosterEntryError points at the first unusable entry of an uploaded roster, counting from 1
+type RosterEntryError struct {
+	Entry int
+}
+
+func (e *RosterEntryError) Error() string {
+	return translate(defaultLanguage, e.Code(), e.Params())
+}
+
+func (e *RosterEntryError) Code() string {
+	return "roster_entry_invalid"
+}
+
+func (e *RosterEntryError) Status() int {
+	return http.StatusBadRequest
+}
+
+func (e *RosterEntryError) Params() map[string]string {
+	return map[string]string{"entry": strconv.Itoa(e.Entry)}
 }
 
 type NoSuchPlayerError struct {
@@ -31,5 +137,116 @@ type NoSuchPlayerError struct {
 }
 
 func (e *NoSuchPlayerError) Error() string {
-	return fmt.Sprintf("player not found: %s", e.Login)
+	return translate(defaultLanguage, e.Code(), e.Params())
+}
+
+func (e *NoSuchPlayerError) Code() string {
+	return "player_not_found"
+}
+
+func (e *NoSuchPlayerError) Status() int {
+	return http.StatusNotFound
+}
+
+func (e *NoSuchPlayerError) Params() map[string]string {
+	return map[string]string{"login": e.Login}
+}
+
+type AuditTamperedError struct {
+	ID uint
+}
+
+func (e *AuditTamperedError) Error() string {
+	return translate(defaultLanguage, e.Code(), e.Params())
+}
+
+func (e *AuditTamperedError) Code() string {
+	return "audit_tampered"
+}
+
+func (e *AuditTamperedError) Status() int {
+	return http.StatusInternalServerError
+}
+
+func (e *AuditTamperedError) Params() map[string]string {
+	return map[string]string{"id": strconv.FormatUint(uint64(e.ID), 10)}
+}
+
+type WrongPasswordError struct {
+	Login string
+}
+
+func (e *WrongPasswordError) Error() string {
+	return translate(defaultLanguage, e.Code(), e.Params())
+}
+
+func (e *WrongPasswordError) Code() string {
+	return "wrong_password"
+}
+
+func (e *WrongPasswordError) Status() int {
+	return http.StatusBadRequest
+}
+
+func (e *WrongPasswordError) Params() map[string]string {
+	return map[string]string{"login": e.Login}
+}
+
+// FieldError is one failed rule of a request body field or query parameter
+type FieldError struct {
+	Field   string            `json:"field"`
+	Rule    string            `json:"rule"`
+	Message string            `json:"message"`
+	params  map[string]string // fill the field.<rule> message
+}
+
+type ValidationError struct {
+	Fields []FieldError
+}
+
+func (e *ValidationError) Error() string {
+	if len(e.Fields) == 1 {
+		return e.Fields[0].Message
+	}
+	return translate(defaultLanguage, e.Code(), nil)
+}
+
+func (e *ValidationError) Code() string {
+	return "invalid_input"
+}
+
+func (e *ValidationError) Status() int {
+	return http.StatusBadRequest
+}
+
+func (e *ValidationError) Params() map[string]string {
+	return nil
+}
+
+// localized returns the field errors with their messages in lang
+func (e *ValidationError) localized(lang string) []FieldError {
+	fields := make([]FieldError, len(e.Fields))
+	for i, field := range e.Fields {
+		fields[i] = newFieldError(lang, field.Field, field.Rule, field.params)
+	}
+	return fields
+}
+
+func newFieldError(lang, field, rule string, params map[string]string) FieldError {
+	all := map[string]string{"field": field, "rule": rule}
+	for name, value := range params {
+		all[name] = value
+	}
+
+	key := "field." + rule
+	if _, ok := catalogue[defaultLanguage][key]; !ok {
+		key = "field.invalid"
+	}
+
+	return FieldError{Field: field, Rule: rule, Message: translate(lang, key, all), params: params}
+}
+
+// invalidParam reports a single bad query parameter or body field
+func invalidParam(field, rule string, params map[string]string) *ValidationError {
+	return &ValidationError{Fields: []FieldError{newFieldError(defaultLanguage, field, rule, params)}}
 }
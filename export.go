@@ -0,0 +1,288 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"log/slog"
+	"strconv"
+	"time"
+)
+
+const (
+	ExportPending = "pending"
+	ExportRunning = "running"
+	ExportDone    = "done"
+	ExportFailed  = "failed"
+)
+
+// exportRetention is how long a finished archive can be downloaded
+const exportRetention = 24 * time.Hour
+
+type ExportJob struct {
+	ID         string `gorm:"primarykey"`
+	CourseID   uint   `gorm:"not null" json:"-"`
+	Login      string `gorm:"not null;index" json:"-"`
+	Status     string `gorm:"not null"`
+	Error      string `json:",omitempty"`
+	Archive    []byte `json:"-"`
+	CreatedAt  time.Time
+	FinishedAt *time.Time `json:",omitempty"`
+}
+
+// PlayerExport is everything the API stores about one player
+type PlayerExport struct {
+	Login        string
+	Score        uint
+	RegisteredAt time.Time
+	User         *User `json:",omitempty"`
+	Scores       []ScoreRecord
+	Sessions     []Session
+	AuditEntries []AuditEntry
+}
+
+var exportQueue = make(chan string, 100)
+
+// RequestExport returns the player's unfinished job or queues a new one
+func RequestExport(ctx context.Context, login string) (ExportJob, error) {
+	if _, err := GetPlayerByLogin(ctx, login); err != nil {
+		return ExportJob{}, err
+	}
+
+	if err := GameDB.WithContext(ctx).Where("created_at < ?", time.Now().Add(-exportRetention)).Delete(&ExportJob{}).Error; err != nil {
+		return ExportJob{}, err
+	}
+
+	var job ExportJob
+	result := GameDB.WithContext(ctx).Scopes(inCourse).Where("login = ? AND status IN ?", login, []string{ExportPending, ExportRunning}).Limit(1).Find(&job)
+	if result.Error != nil {
+		return ExportJob{}, result.Error
+	}
+	if result.RowsAffected > 0 {
+		return job, nil
+	}
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return ExportJob{}, err
+	}
+
+	job = ExportJob{ID: hex.EncodeToString(id), CourseID: courseFrom(ctx).ID, Login: login, Status: ExportPending}
+	if err := GameDB.WithContext(ctx).Create(&job).Error; err != nil {
+		return ExportJob{}, err
+	}
+
+	select {
+	case exportQueue <- job.ID:
+	default:
+		job.Status, job.Error = ExportFailed, "export queue is full, try again later"
+		if err := GameDB.WithContext(ctx).Model(&job).Updates(ExportJob{Status: job.Status, Error: job.Error}).Error; err != nil {
+			return ExportJob{}, err
+		}
+	}
+
+	return job, nil
+}
+
+// GetExportJob looks the job up only among the player's own jobs
+func GetExportJob(ctx context.Context, login, id string) (ExportJob, error) {
+	var job ExportJob
+	result := GameDB.WithContext(ctx).Scopes(inCourse).Where("id = ? AND login = ?", id, login).First(&job)
+	return job, result.Error
+}
+
+// StartExportWorker builds queued archives one at a time. On shutdown it finishes the archive
+// it is building, jobs still queued stay pending and are queued again when the server next starts
+func StartExportWorker() {
+	Workers.Run("export_worker", func(ctx context.Context) {
+		requeueExports(ctx)
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case id := <-exportQueue:
+				jobCtx, span := tracer.Start(context.Background(), "export.run", trace.WithAttributes(attribute.String("export.id", id)))
+				runExportJob(jobCtx, id)
+				span.End()
+			}
+		}
+	})
+}
+
+// requeueExports picks up the jobs a previous run left unfinished
+func requeueExports(ctx context.Context) {
+	var ids []string
+	err := GameDB.WithContext(ctx).Model(&ExportJob{}).
+		Where("status IN ?", []string{ExportPending, ExportRunning}).
+		Order("created_at").Limit(cap(exportQueue)).
+		Pluck("id", &ids).Error
+	if err != nil {
+		logger(ctx).Error("failed to requeue unfinished exports", slog.Any("error", err))
+		return
+	}
+
+	for _, id := range ids {
+		select {
+		case exportQueue <- id:
+		default:
+			return
+		}
+	}
+	if len(ids) > 0 {
+		logger(ctx).Info("requeued unfinished exports", slog.Int("count", len(ids)))
+	}
+}
+
+func runExportJob(ctx context.Context, id string) {
+	var job ExportJob
+	if err := GameDB.WithContext(ctx).Where("id = ?", id).First(&job).Error; err != nil {
+		logger(ctx).Warn("export job vanished", slog.String("export_id", id), slog.Any("error", err))
+		return
+	}
+
+	// the archive is built with the eyes of a request to the job's course
+	course, err := courseByID(ctx, job.CourseID)
+	if err != nil {
+		logger(ctx).Error("export job course could not be loaded", slog.String("export_id", id), slog.Any("error", err))
+		return
+	}
+	ctx = withCourse(ctx, course)
+
+	if err := GameDB.WithContext(ctx).Model(&job).Update("status", ExportRunning).Error; err != nil {
+		logger(ctx).Error("export job could not be started", slog.String("export_id", id), slog.Any("error", err))
+		return
+	}
+
+	archive, err := buildExportArchive(ctx, job.Login)
+	now := time.Now()
+	if err != nil {
+		logger(ctx).Error("export job failed", slog.String("export_id", id), slog.String("login", job.Login), slog.Any("error", err))
+		err = GameDB.WithContext(ctx).Model(&job).Updates(ExportJob{Status: ExportFailed, Error: err.Error(), FinishedAt: &now}).Error
+	} else {
+		err = GameDB.WithContext(ctx).Model(&job).Updates(ExportJob{Status: ExportDone, Archive: archive, FinishedAt: &now}).Error
+	}
+
+	if err != nil {
+		logger(ctx).Error("export job result could not be saved", slog.String("export_id", id), slog.Any("error", err))
+	}
+}
+
+func collectPlayerExport(ctx context.Context, login string) (PlayerExport, error) {
+	player, err := GetPlayerByLogin(ctx, login)
+	if err != nil {
+		return PlayerExport{}, err
+	}
+
+	export := PlayerExport{
+		Login:        player.Login,
+		Score:        player.Score,
+		RegisteredAt: player.CreatedAt,
+	}
+
+	user, err := Users.GetUser(ctx, login)
+	if err == nil {
+		export.User = &user
+	} else if !errors.Is(err, ErrUserNotFound) {
+		return PlayerExport{}, err
+	}
+
+	if export.Scores, err = GetScoreHistory(ctx, player.ID); err != nil {
+		return PlayerExport{}, err
+	}
+
+	if err = GameDB.WithContext(ctx).Scopes(inCourse).Where("login = ?", login).Order("created_at").Find(&export.Sessions).Error; err != nil {
+		return PlayerExport{}, err
+	}
+
+	if export.AuditEntries, err = GetAuditEntries(ctx, AuditFilter{Login: login}); err != nil {
+		return PlayerExport{}, err
+	}
+
+	return export, nil
+}
+
+// buildExportArchive zips the export as one JSON document plus a CSV file per table
+func buildExportArchive(ctx context.Context, login string) ([]byte, error) {
+	export, err := collectPlayerExport(ctx, login)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	archive := zip.NewWriter(&buf)
+
+	file, err := archive.Create("export.json")
+	if err != nil {
+		return nil, err
+	}
+	encoder := json.NewEncoder(file)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(export); err != nil {
+		return nil, err
+	}
+
+	profile := [][]string{
+		{"login", "score", "registered_at", "telegram_username", "name"},
+		{csvText(export.Login), strconv.FormatUint(uint64(export.Score), 10), export.RegisteredAt.Format(time.RFC3339), "", ""},
+	}
+	if export.User != nil {
+		profile[1][3] = csvText(export.User.Username)
+		profile[1][4] = csvText(export.User.Name)
+	}
+
+	scores := [][]string{{"submitted_at", "score"}}
+	for _, record := range export.Scores {
+		scores = append(scores, []string{record.CreatedAt.Format(time.RFC3339), strconv.FormatUint(uint64(record.Score), 10)})
+	}
+
+	sessions := [][]string{{"created_at", "expires_at", "revoked_at", "ip", "user_agent"}}
+	for _, session := range export.Sessions {
+		revokedAt := ""
+		if session.RevokedAt != nil {
+			revokedAt = session.RevokedAt.Format(time.RFC3339)
+		}
+		sessions = append(sessions, []string{
+			session.CreatedAt.Format(time.RFC3339), session.ExpiresAt.Format(time.RFC3339), revokedAt, csvText(session.IP), csvText(session.UserAgent),
+		})
+	}
+
+	audit := [][]string{{"created_at", "event", "actor", "ip", "user_agent", "details"}}
+	for _, entry := range export.AuditEntries {
+		audit = append(audit, []string{
+			entry.CreatedAt.Format(time.RFC3339), entry.Event, csvText(entry.Actor), csvText(entry.IP), csvText(entry.UserAgent), csvText(entry.Details),
+		})
+	}
+
+	// user agents, addresses and audit details come from clients, csvText keeps them from running as formulas
+	tables := []struct {
+		name string
+		rows [][]string
+	}{
+		{"profile.csv", profile},
+		{"scores.csv", scores},
+		{"sessions.csv", sessions},
+		{"audit.csv", audit},
+	}
+	for _, table := range tables {
+		file, err := archive.Create(table.name)
+		if err != nil {
+			return nil, err
+		}
+		if err := csv.NewWriter(file).WriteAll(table.rows); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := archive.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
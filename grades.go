@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// GradeThreshold gives Grade to every score of at least MinScore
+type GradeThreshold struct {
+	MinScore uint   `yaml:"min_score"`
+	Grade    string `yaml:"grade"`
+}
+
+// gradeThresholds is grades.thresholds, highest score first
+var gradeThresholds []GradeThreshold
+
+// GradeRow is one student of a grade sheet
+type GradeRow struct {
+	Name     string
+	Username string
+	Score    uint
+	Grade    string // empty when no threshold is reached
+}
+
+var gradeColumns = []string{"name", "username", "score", "grade"}
+
+// ParseGradeThresholds reads a table like "900:10,800:9,0:4" and sorts it by score, highest first
+func ParseGradeThresholds(value string) ([]GradeThreshold, error) {
+	var thresholds []GradeThreshold
+	for _, pair := range strings.Split(value, ",") {
+		score, grade, found := strings.Cut(strings.TrimSpace(pair), ":")
+		minScore, err := strconv.ParseUint(score, 10, 0)
+		if !found || err != nil {
+			return nil, fmt.Errorf("grade threshold must look like score:grade, got %q", pair)
+		}
+		thresholds = append(thresholds, GradeThreshold{MinScore: uint(minScore), Grade: grade})
+	}
+
+	sortGradeThresholds(thresholds)
+	return thresholds, nil
+}
+
+func sortGradeThresholds(thresholds []GradeThreshold) {
+	sort.SliceStable(thresholds, func(i, j int) bool {
+		return thresholds[i].MinScore > thresholds[j].MinScore
+	})
+}
+
+// gradeFor returns the grade of the highest threshold the score reaches
+func gradeFor(thresholds []GradeThreshold, score uint) string {
+	for _, threshold := range thresholds {
+		if score >= threshold.MinScore {
+			return threshold.Grade
+		}
+	}
+	return ""
+}
+
+// bestScores returns the best score each player of the course of ctx submitted up to and including deadline
+func bestScores(ctx context.Context, deadline time.Time) (map[string]uint, error) {
+	var rows []struct {
+		Login string
+		Score uint
+	}
+	err := GameDB.WithContext(ctx).Model(&ScoreRecord{}).
+		Select("players.login, MAX(score_records.score) AS score").
+		Joins("JOIN players ON players.id = score_records.player_id").
+		Where("players.course_id = ? AND score_records.created_at <= ?", courseFrom(ctx).ID, deadline).
+		Group("players.login").
+		Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+
+	scores := make(map[string]uint, len(rows))
+	for _, row := range rows {
+		scores[row.Login] = row.Score
+	}
+	return scores, nil
+}
+
+// GradeSheet lists every course user with their best score up to the deadline, ordered by username.
+// Students who never played score 0
+func GradeSheet(ctx context.Context, deadline time.Time) ([]GradeRow, error) {
+	users, err := allUsers(ctx, Users)
+	if err != nil {
+		return nil, err
+	}
+
+	scores, err := bestScores(ctx, deadline)
+	if err != nil {
+		return nil, err
+	}
+
+	rows := make([]GradeRow, len(users))
+	for i, user := range users {
+		score := scores[user.Username]
+		rows[i] = GradeRow{Name: user.Name, Username: user.Username, Score: score, Grade: gradeFor(gradeThresholds, score)}
+	}
+	return rows, nil
+}
+
+// csvText keeps spreadsheet programs from running a cell as a formula: a student named "=HYPERLINK(...)"
+// gets a leading quote, which shows the name as typed
+func csvText(value string) string {
+	if value != "" && strings.ContainsRune("=+-@", rune(value[0])) {
+		return "'" + value
+	}
+	return value
+}
+
+func writeGradesCSV(w io.Writer, rows []GradeRow) error {
+	out := csv.NewWriter(w)
+	if err := out.Write(gradeColumns); err != nil {
+		return err
+	}
+	for _, row := range rows {
+		if err := out.Write([]string{csvText(row.Name), csvText(row.Username), strconv.FormatUint(uint64(row.Score), 10), csvText(row.Grade)}); err != nil {
+			return err
+		}
+	}
+	out.Flush()
+	return out.Error()
+}
+
+func writeGradesXLSX(w io.Writer, rows []GradeRow) error {
+	cells := make([][]interface{}, 0, len(rows)+1)
+	header := make([]interface{}, len(gradeColumns))
+	for i, column := range gradeColumns {
+		header[i] = column
+	}
+	cells = append(cells, header)
+	for _, row := range rows {
+		cells = append(cells, []interface{}{row.Name, row.Username, row.Score, row.Grade})
+	}
+	return writeXLSX(w, "Grades", cells)
+}
+
+// writeGrades writes the sheet as csv or xlsx
+func writeGrades(w io.Writer, rows []GradeRow, format string) error {
+	if format == "xlsx" {
+		return writeGradesXLSX(w, rows)
+	}
+	return writeGradesCSV(w, rows)
+}
+
+// ExportGrades godoc
+// @Summary Grade sheet at a deadline
+// @Tags admin
+// @x-v1 true
+// @x-v2 true
+// @Description Every course user with the best score they submitted up to and including the deadline, and the grade grades.thresholds gives it. Students who never played score 0. Requires an admin JWT.
+// @Produce text/csv
+// @Produce application/vnd.openxmlformats-officedocument.spreadsheetml.sheet
+// @Param deadline query string true "RFC3339 timestamp"
+// @Param format query string false "csv or xlsx" default(csv)
+// @Success 200 {file} file "Columns name, username, score, grade"
+// @Failure 400 {object} Problem "Invalid deadline or format"
+// @Failure 401 {object} Problem "Unauthorized or missing token"
+// @Failure 403 {object} Problem "Admin access required"
+// @Failure 500 {object} Problem "Internal server error"
+// @Failure 503 {object} Problem "Database is unavailable"
+// @Router /admin/grades [get]
+func ExportGrades(c *gin.Context) {
+	deadline, err := time.Parse(time.RFC3339, c.Query("deadline"))
+	if err != nil {
+		rule := "rfc3339"
+		if c.Query("deadline") == "" {
+			rule = "required"
+		}
+		respondError(c, invalidParam("deadline", rule, nil))
+		return
+	}
+
+	format := c.DefaultQuery("format", "csv")
+	contentType, ok := map[string]string{
+		"csv":  "text/csv; charset=utf-8",
+		"xlsx": "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+	}[format]
+	if !ok {
+		respondError(c, invalidParam("format", "oneof", map[string]string{"values": "csv, xlsx"}))
+		return
+	}
+
+	rows, err := GradeSheet(c.Request.Context(), deadline)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	var sheet bytes.Buffer
+	if err := writeGrades(&sheet, rows, format); err != nil {
+		respondError(c, err)
+		return
+	}
+
+	audit(c, AuditAdminGradesExport, "", fmt.Sprintf("%d students at %s", len(rows), deadline.Format(time.RFC3339)))
+
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="grades-%s.%s"`, deadline.Format(time.DateOnly), format))
+	c.Data(http.StatusOK, contentType, sheet.Bytes())
+}
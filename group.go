@@ -0,0 +1,435 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const defaultStandingsTop = 3
+
+// Group is a lab group of a course. Groups compete on the standings by the scores of their members
+type Group struct {
+	ID        uint      `gorm:"primarykey" json:"-"`
+	CourseID  uint      `gorm:"not null" json:"-"`
+	CreatedAt time.Time `json:"-"`
+	Slug      string    `gorm:"not null" json:"slug"` // unique within the course
+	Name      string    `gorm:"not null" json:"name"`
+	// Members counts logins in the group, registered or not
+	Members int64 `gorm:"->" json:"members"`
+}
+
+// GroupMember puts a login into a group. A login is in at most one group of a course
+type GroupMember struct {
+	GroupID   uint   `gorm:"primarykey"`
+	CourseID  uint   `gorm:"not null"`
+	Login     string `gorm:"primarykey"`
+	CreatedAt time.Time
+}
+
+type GroupRequest struct {
+	Slug string `json:"slug" binding:"required"`
+	Name string `json:"name" binding:"required"`
+}
+
+// GroupStanding is the place of a group in a group-vs-group competition
+type GroupStanding struct {
+	Rank    int     `json:"rank"` // groups with the same score share a rank
+	Group   string  `json:"group"`
+	Name    string  `json:"name"`
+	Players int     `json:"players"` // registered members, the ones with a score
+	Score   float64 `json:"score"`   // average or top_sum, whichever was asked for
+	Average float64 `json:"average"`
+	TopSum  uint    `json:"top_sum"` // sum of the best top scores
+}
+
+func GetGroup(ctx context.Context, slug string) (Group, error) {
+	var group Group
+	result := GameDB.WithContext(ctx).Scopes(inCourse).Where("slug = ?", slug).First(&group)
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return group, ErrGroupNotFound
+	}
+	return group, result.Error
+}
+
+func FindGroups(ctx context.Context) ([]Group, error) {
+	var groups []Group
+	result := GameDB.WithContext(ctx).Model(&Group{}).Scopes(inCourse).
+		Select("groups.*, (SELECT COUNT(*) FROM group_members WHERE group_members.group_id = groups.id) AS members").
+		Order("slug").Find(&groups)
+	return groups, result.Error
+}
+
+func CreateGroup(ctx context.Context, slug, name string) (Group, error) {
+	if !slugPattern.MatchString(slug) {
+		return Group{}, invalidParam("slug", "invalid", nil)
+	}
+
+	if _, err := GetGroup(ctx, slug); err == nil {
+		return Group{}, ErrGroupExists
+	} else if !errors.Is(err, ErrGroupNotFound) {
+		return Group{}, err
+	}
+
+	// the check above misses a concurrent request creating the same slug, idx_groups_course_slug does not
+	group := Group{CourseID: courseFrom(ctx).ID, Slug: slug, Name: name}
+	if err := GameDB.WithContext(ctx).Omit("Members").Create(&group).Error; err != nil {
+		if isUniqueViolation(err) {
+			return Group{}, ErrGroupExists
+		}
+		return Group{}, err
+	}
+	return group, nil
+}
+
+// DeleteGroup removes the group, its members stay on the course without a group
+func DeleteGroup(ctx context.Context, slug string) error {
+	result := GameDB.WithContext(ctx).Scopes(inCourse).Where("slug = ?", slug).Delete(&Group{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrGroupNotFound
+	}
+	return nil
+}
+
+// joinGroups puts the logins into the group, moving them out of any other group of the course
+func joinGroups(tx *gorm.DB, group Group, logins []string) error {
+	members := make([]GroupMember, len(logins))
+	for i, login := range logins {
+		members[i] = GroupMember{GroupID: group.ID, CourseID: group.CourseID, Login: login}
+	}
+
+	return tx.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "course_id"}, {Name: "login"}},
+		DoUpdates: clause.AssignmentColumns([]string{"group_id", "created_at"}),
+	}).CreateInBatches(members, 500).Error
+}
+
+// JoinGroup puts the course user with login into the group, moving them out of their old group
+func JoinGroup(ctx context.Context, slug, login string) error {
+	group, err := GetGroup(ctx, slug)
+	if err != nil {
+		return err
+	}
+
+	if _, err := Users.GetUser(ctx, login); err != nil {
+		if errors.Is(err, ErrUserNotFound) {
+			return &NoSuchUserError{Login: login}
+		}
+		return err
+	}
+
+	return joinGroups(GameDB.WithContext(ctx), group, []string{login})
+}
+
+func LeaveGroup(ctx context.Context, slug, login string) error {
+	group, err := GetGroup(ctx, slug)
+	if err != nil {
+		return err
+	}
+
+	result := GameDB.WithContext(ctx).Where("group_id = ? AND login = ?", group.ID, login).Delete(&GroupMember{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrNotInGroup
+	}
+	return nil
+}
+
+// ReplaceGroupMembers makes the usernames of an imported roster the members of the group.
+// Students listed there leave their old group
+func ReplaceGroupMembers(ctx context.Context, slug string, users []User) (Group, error) {
+	group, err := GetGroup(ctx, slug)
+	if err != nil {
+		return group, err
+	}
+
+	logins := make([]string, len(users))
+	for i, user := range users {
+		logins[i] = user.Username
+	}
+
+	err = GameDB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("group_id = ?", group.ID).Delete(&GroupMember{}).Error; err != nil {
+			return err
+		}
+		return joinGroups(tx, group, logins)
+	})
+	group.Members = int64(len(logins))
+	return group, err
+}
+
+// GroupStandings ranks the groups of the course by the average score of their registered members,
+// or with aggregate "top" by the sum of their best top scores
+func GroupStandings(ctx context.Context, aggregate string, top int) ([]GroupStanding, error) {
+	course := courseFrom(ctx).ID
+
+	var standings []GroupStanding
+	err := GameDB.WithContext(ctx).Raw(`WITH ranked AS (
+			SELECT group_members.group_id, players.score,
+				row_number() OVER (PARTITION BY group_members.group_id ORDER BY players.score DESC) AS place
+			FROM group_members
+			JOIN players ON players.course_id = group_members.course_id AND players.login = group_members.login
+			WHERE group_members.course_id = ? AND players.deleted_at IS NULL AND players.deactivated_at IS NULL
+		)
+		SELECT groups.slug AS "group", groups.name, COUNT(ranked.score) AS players,
+			COALESCE(AVG(ranked.score), 0) AS average,
+			COALESCE(SUM(ranked.score) FILTER (WHERE ranked.place <= ?), 0) AS top_sum
+		FROM groups LEFT JOIN ranked ON ranked.group_id = groups.id
+		WHERE groups.course_id = ?
+		GROUP BY groups.id`, course, top, course).Scan(&standings).Error
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range standings {
+		standings[i].Score = standings[i].Average
+		if aggregate == "top" {
+			standings[i].Score = float64(standings[i].TopSum)
+		}
+	}
+	sort.Slice(standings, func(i, j int) bool {
+		if standings[i].Score != standings[j].Score {
+			return standings[i].Score > standings[j].Score
+		}
+		return standings[i].Group < standings[j].Group
+	})
+	for i := range standings {
+		standings[i].Rank = i + 1
+		if i > 0 && standings[i].Score == standings[i-1].Score {
+			standings[i].Rank = standings[i-1].Rank
+		}
+	}
+
+	return standings, nil
+}
+
+// ListGroups godoc
+// @Summary List the groups of the course
+// @Tags groups
+// @x-v1 true
+// @x-v2 true
+// @Description The leaderboard of one group is /players?group={slug}.
+// @Produce json
+// @Success 200 {array} Group
+// @Failure 500 {object} Problem
+// @Failure 503 {object} Problem "Database is unavailable"
+// @Router /groups [get]
+func ListGroups(c *gin.Context) {
+	groups, err := FindGroups(c.Request.Context())
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, groups)
+}
+
+// ListGroupStandings godoc
+// @Summary Group-vs-group standings
+// @Tags groups
+// @x-v1 true
+// @x-v2 true
+// @Description Ranks every group of the course by the average score of its registered members, or by the sum of its best top scores. Deactivated players do not count.
+// @Produce json
+// @Param aggregate query string false "average or top" default(average)
+// @Param top query int false "Scores summed per group for aggregate=top (1-100)" default(3)
+// @Success 200 {array} GroupStanding
+// @Failure 400 {object} Problem
+// @Failure 500 {object} Problem
+// @Failure 503 {object} Problem "Database is unavailable"
+// @Router /groups/standings [get]
+func ListGroupStandings(c *gin.Context) {
+	aggregate := c.DefaultQuery("aggregate", "average")
+	if aggregate != "average" && aggregate != "top" {
+		respondError(c, invalidParam("aggregate", "oneof", map[string]string{"values": "average, top"}))
+		return
+	}
+
+	top := defaultStandingsTop
+	if value := c.Query("top"); value != "" {
+		var err error
+		if top, err = strconv.Atoi(value); err != nil || top < 1 || top > 100 {
+			respondError(c, invalidParam("top", "range", map[string]string{"min": "1", "max": "100"}))
+			return
+		}
+	}
+
+	standings, err := GroupStandings(c.Request.Context(), aggregate, top)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, standings)
+}
+
+// AddGroup godoc
+// @Summary Create a group
+// @Tags admin
+// @x-v1 true
+// @x-v2 true
+// @Description Creates an empty group in the course. Requires an admin JWT.
+// @Accept json
+// @Produce json
+// @Param body body GroupRequest true "Slug (lowercase letters, digits and dashes) and display name"
+// @Success 201 {object} Group
+// @Failure 400 {object} Problem "Invalid input"
+// @Failure 401 {object} Problem "Unauthorized or missing token"
+// @Failure 403 {object} Problem "Admin access required"
+// @Failure 409 {object} Problem "Group exists"
+// @Failure 500 {object} Problem "Internal server error"
+// @Failure 503 {object} Problem "Database is unavailable"
+// @Router /admin/groups [post]
+func AddGroup(c *gin.Context) {
+	var json GroupRequest
+
+	if err := c.ShouldBindJSON(&json); err != nil {
+		respondError(c, bindingError(err))
+		return
+	}
+
+	group, err := CreateGroup(c.Request.Context(), json.Slug, json.Name)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	audit(c, AuditAdminGroupCreate, "", group.Slug)
+
+	c.IndentedJSON(http.StatusCreated, group)
+}
+
+// RemoveGroup godoc
+// @Summary Delete a group
+// @Tags admin
+// @x-v1 true
+// @x-v2 true
+// @Description Deletes the group. Its members and their scores stay on the course. Requires an admin JWT.
+// @Produce json
+// @Param group path string true "Group slug"
+// @Success 200 {object} map[string]string "Group deleted"
+// @Failure 401 {object} Problem "Unauthorized or missing token"
+// @Failure 403 {object} Problem "Admin access required"
+// @Failure 404 {object} Problem "No such group"
+// @Failure 500 {object} Problem "Internal server error"
+// @Failure 503 {object} Problem "Database is unavailable"
+// @Router /admin/groups/{group} [delete]
+func RemoveGroup(c *gin.Context) {
+	slug := c.Param("group")
+
+	if err := DeleteGroup(c.Request.Context(), slug); err != nil {
+		respondError(c, err)
+		return
+	}
+
+	audit(c, AuditAdminGroupDelete, "", slug)
+
+	c.IndentedJSON(http.StatusOK, gin.H{"message": message(c, "group_deleted")})
+}
+
+// AddGroupMember godoc
+// @Summary Put a student into a group
+// @Tags admin
+// @x-v1 true
+// @x-v2 true
+// @Description Adds the course user with the login to the group, moving them out of their old group. They do not have to be registered yet. Requires an admin JWT.
+// @Produce json
+// @Param group path string true "Group slug"
+// @Param login path string true "Login"
+// @Success 200 {object} map[string]string "Member added"
+// @Failure 400 {object} Problem "No such user on the course"
+// @Failure 401 {object} Problem "Unauthorized or missing token"
+// @Failure 403 {object} Problem "Admin access required"
+// @Failure 404 {object} Problem "No such group"
+// @Failure 500 {object} Problem "Internal server error"
+// @Failure 503 {object} Problem "Database is unavailable"
+// @Router /admin/groups/{group}/members/{login} [put]
+func AddGroupMember(c *gin.Context) {
+	slug, login := c.Param("group"), c.Param("login")
+
+	if err := JoinGroup(c.Request.Context(), slug, login); err != nil {
+		respondError(c, err)
+		return
+	}
+
+	audit(c, AuditAdminGroupMembers, login, "joined "+slug)
+
+	c.IndentedJSON(http.StatusOK, gin.H{"message": message(c, "group_member_added")})
+}
+
+// RemoveGroupMember godoc
+// @Summary Take a student out of a group
+// @Tags admin
+// @x-v1 true
+// @x-v2 true
+// @Description Requires an admin JWT.
+// @Produce json
+// @Param group path string true "Group slug"
+// @Param login path string true "Login"
+// @Success 200 {object} map[string]string "Member removed"
+// @Failure 401 {object} Problem "Unauthorized or missing token"
+// @Failure 403 {object} Problem "Admin access required"
+// @Failure 404 {object} Problem "No such group or not a member"
+// @Failure 500 {object} Problem "Internal server error"
+// @Failure 503 {object} Problem "Database is unavailable"
+// @Router /admin/groups/{group}/members/{login} [delete]
+func RemoveGroupMember(c *gin.Context) {
+	slug, login := c.Param("group"), c.Param("login")
+
+	if err := LeaveGroup(c.Request.Context(), slug, login); err != nil {
+		respondError(c, err)
+		return
+	}
+
+	audit(c, AuditAdminGroupMembers, login, "left "+slug)
+
+	c.IndentedJSON(http.StatusOK, gin.H{"message": message(c, "group_member_removed")})
+}
+
+// UploadGroupMembers godoc
+// @Summary Import the members of a group from a roster
+// @Tags admin
+// @x-v1 true
+// @x-v2 true
+// @Description Replaces the members of the group with the usernames of the uploaded roster, in the format of /admin/roster. Students listed there leave their old group. Requires an admin JWT.
+// @Accept multipart/form-data
+// @Produce json
+// @Param group path string true "Group slug"
+// @Param file formData file true "Roster as .csv or .json"
+// @Success 200 {object} Group
+// @Failure 400 {object} Problem "Invalid or empty roster"
+// @Failure 401 {object} Problem "Unauthorized or missing token"
+// @Failure 403 {object} Problem "Admin access required"
+// @Failure 404 {object} Problem "No such group"
+// @Failure 500 {object} Problem "Internal server error"
+// @Failure 503 {object} Problem "Database is unavailable"
+// @Router /admin/groups/{group}/members [post]
+func UploadGroupMembers(c *gin.Context) {
+	users, err := rosterUpload(c)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	group, err := ReplaceGroupMembers(c.Request.Context(), c.Param("group"), users)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	audit(c, AuditAdminGroupMembers, "", fmt.Sprintf("%s: imported %d members", group.Slug, group.Members))
+
+	c.IndentedJSON(http.StatusOK, group)
+}
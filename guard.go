@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"math"
+	"sync"
+	"time"
+)
+
+// LoginAttempt counts consecutive failed logins for one key ("login:<login>" or "ip:<address>")
+type LoginAttempt struct {
+	Key         string    `gorm:"primarykey"`
+	Failures    int       `gorm:"not null;default:0"`
+	LastFailure time.Time `gorm:"not null"`
+	LockedUntil time.Time
+}
+
+type AttemptStore interface {
+	Get(key string) (LoginAttempt, error)
+	// Fail records a failed attempt under policy in one step, so parallel guesses cannot lose increments
+	Fail(key string, policy GuardPolicy, now time.Time) (LoginAttempt, error)
+	Delete(key string) error
+}
+
+// GuardPolicy describes how fast a key is slowed down and when it is locked out
+type GuardPolicy struct {
+	FreeAttempts     int           // failures allowed before any delay
+	BaseDelay        time.Duration // first delay, doubled with every further failure
+	MaxDelay         time.Duration
+	LockoutThreshold int // failures that trigger a lockout
+	LockoutDuration  time.Duration
+	ResetAfter       time.Duration // quiet period after which failures are forgotten
+}
+
+var (
+	LoginPolicy = GuardPolicy{
+		FreeAttempts:     3,
+		BaseDelay:        time.Second,
+		MaxDelay:         5 * time.Minute,
+		LockoutThreshold: 10,
+		LockoutDuration:  15 * time.Minute,
+		ResetAfter:       time.Hour,
+	}
+	IPPolicy = GuardPolicy{
+		FreeAttempts:     20,
+		BaseDelay:        time.Second,
+		MaxDelay:         5 * time.Minute,
+		LockoutThreshold: 100,
+		LockoutDuration:  30 * time.Minute,
+		ResetAfter:       time.Hour,
+	}
+)
+
+const memoryStorePruneSize = 10000
+
+var LoginAttempts AttemptStore = NewMemoryAttemptStore()
+
+// loginKey counts failures per course, a login in one course says nothing about the same login in another
+func loginKey(ctx context.Context, login string) string {
+	if namespace := courseFrom(ctx).namespace(); namespace != "" {
+		return "login:" + namespace + "/" + login
+	}
+	return "login:" + login
+}
+
+func ipKey(ip string) string {
+	return "ip:" + ip
+}
+
+// blockedUntil returns the moment the key may try again
+func (p GuardPolicy) blockedUntil(attempt LoginAttempt) time.Time {
+	if attempt.LockedUntil.After(attempt.LastFailure) {
+		return attempt.LockedUntil
+	}
+
+	if attempt.Failures < p.FreeAttempts {
+		return time.Time{}
+	}
+
+	delay := time.Duration(float64(p.BaseDelay) * math.Pow(2, float64(attempt.Failures-p.FreeAttempts)))
+	if delay > p.MaxDelay || delay <= 0 {
+		delay = p.MaxDelay
+	}
+
+	return attempt.LastFailure.Add(delay)
+}
+
+// RetryAfter reports how long the key has to wait before the next attempt, zero if it may try now
+func (p GuardPolicy) RetryAfter(key string) (time.Duration, error) {
+	attempt, err := LoginAttempts.Get(key)
+	if err != nil {
+		return 0, err
+	}
+
+	wait := time.Until(p.blockedUntil(attempt))
+	if wait < 0 {
+		return 0, nil
+	}
+	return wait, nil
+}
+
+// fail counts one more failure of the attempt at now
+func (p GuardPolicy) fail(attempt LoginAttempt, now time.Time) LoginAttempt {
+	if now.Sub(attempt.LastFailure) > p.ResetAfter && now.After(attempt.LockedUntil) {
+		attempt.Failures = 0
+	}
+
+	attempt.Failures++
+	attempt.LastFailure = now
+	if attempt.Failures >= p.LockoutThreshold {
+		attempt.LockedUntil = now.Add(p.LockoutDuration)
+		attempt.Failures = 0
+	}
+	return attempt
+}
+
+// Fail records a failed attempt and returns the resulting wait
+func (p GuardPolicy) Fail(key string) (time.Duration, error) {
+	attempt, err := LoginAttempts.Fail(key, p, time.Now())
+	if err != nil {
+		return 0, err
+	}
+
+	wait := time.Until(p.blockedUntil(attempt))
+	if wait < 0 {
+		return 0, nil
+	}
+	return wait, nil
+}
+
+func ResetLoginAttempts(key string) error {
+	return LoginAttempts.Delete(key)
+}
+
+type MemoryAttemptStore struct {
+	mu       sync.Mutex
+	attempts map[string]LoginAttempt
+}
+
+func NewMemoryAttemptStore() *MemoryAttemptStore {
+	return &MemoryAttemptStore{attempts: make(map[string]LoginAttempt)}
+}
+
+func (s *MemoryAttemptStore) Get(key string) (LoginAttempt, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.attempts[key], nil
+}
+
+func (s *MemoryAttemptStore) Fail(key string, policy GuardPolicy, now time.Time) (LoginAttempt, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// forget stale keys so guessing random logins cannot grow the map forever
+	if len(s.attempts) >= memoryStorePruneSize {
+		for key, a := range s.attempts {
+			if now.Sub(a.LastFailure) > time.Hour && now.After(a.LockedUntil) {
+				delete(s.attempts, key)
+			}
+		}
+	}
+
+	attempt := s.attempts[key]
+	attempt.Key = key
+	attempt = policy.fail(attempt, now)
+	s.attempts[key] = attempt
+	return attempt, nil
+}
+
+func (s *MemoryAttemptStore) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.attempts, key)
+	return nil
+}
+
+// DBAttemptStore shares the counters between all API instances
+type DBAttemptStore struct {
+	db *gorm.DB
+}
+
+func NewDBAttemptStore(db *gorm.DB) *DBAttemptStore {
+	return &DBAttemptStore{db: db}
+}
+
+func (s *DBAttemptStore) Get(key string) (LoginAttempt, error) {
+	var attempt LoginAttempt
+	result := s.db.Where("key = ?", key).First(&attempt)
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return LoginAttempt{Key: key}, nil
+	}
+	return attempt, result.Error
+}
+
+func (s *DBAttemptStore) Fail(key string, policy GuardPolicy, now time.Time) (LoginAttempt, error) {
+	var attempt LoginAttempt
+
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		// make sure the row exists so it can be locked
+		if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&LoginAttempt{Key: key, LastFailure: now}).Error; err != nil {
+			return err
+		}
+
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("key = ?", key).First(&attempt).Error; err != nil {
+			return err
+		}
+
+		attempt = policy.fail(attempt, now)
+		return tx.Save(&attempt).Error
+	})
+
+	return attempt, err
+}
+
+func (s *DBAttemptStore) Delete(key string) error {
+	return s.db.Where("key = ?", key).Delete(&LoginAttempt{}).Error
+}
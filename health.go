@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5/pgconn"
+	"gorm.io/gorm"
+	"io"
+	"log"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// dbProbeInterval is how often an unreachable database is pinged until it answers again
+const dbProbeInterval = 5 * time.Second
+
+// dbHealth follows the outcome of every query. Once the database looks unreachable, requests are
+// answered with 503 right away and a background probe waits for it to come back
+type dbHealth struct {
+	mu        sync.Mutex
+	healthy   bool
+	lastError error
+	since     time.Time
+	probing   bool
+}
+
+var DBHealth = &dbHealth{healthy: true, since: time.Now()}
+
+// Healthy reports the current state and the error that caused an outage
+func (h *dbHealth) Healthy() (bool, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.healthy, h.lastError
+}
+
+func (h *dbHealth) report(err error) {
+	if err != nil && !isUnavailable(err) {
+		return // the database answered, the query itself was wrong
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if err == nil {
+		if !h.healthy {
+			slog.Info("database is reachable again", slog.Duration("outage", time.Since(h.since).Round(time.Second)))
+			h.healthy, h.lastError, h.since = true, nil, time.Now()
+		}
+		return
+	}
+
+	if h.healthy {
+		slog.Error("database became unreachable", slog.Any("error", err))
+		h.healthy, h.since = false, time.Now()
+	}
+	h.lastError = err
+
+	if !h.probing {
+		h.probing = true
+		go h.probe()
+	}
+}
+
+// probe pings the database until it answers
+func (h *dbHealth) probe() {
+	ticker := time.NewTicker(dbProbeInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		err := pingDB(GameDB, dbProbeInterval)
+		h.report(err)
+
+		if err == nil {
+			h.mu.Lock()
+			h.probing = false
+			h.mu.Unlock()
+			return
+		}
+	}
+}
+
+func pingDB(db *gorm.DB, timeout time.Duration) error {
+	sqlDB, err := db.DB()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return sqlDB.PingContext(ctx)
+}
+
+// registerHealthCallbacks feeds the result of every gorm operation into DBHealth
+func registerHealthCallbacks(db *gorm.DB) {
+	callback := func(tx *gorm.DB) {
+		if errors.Is(tx.Error, gorm.ErrRecordNotFound) {
+			DBHealth.report(nil)
+			return
+		}
+		DBHealth.report(tx.Error)
+	}
+
+	for name, processor := range map[string]interface {
+		Register(name string, fn func(*gorm.DB)) error
+	}{
+		"health:create": db.Callback().Create().After("gorm:create"),
+		"health:query":  db.Callback().Query().After("gorm:query"),
+		"health:update": db.Callback().Update().After("gorm:update"),
+		"health:delete": db.Callback().Delete().After("gorm:delete"),
+		"health:row":    db.Callback().Row().After("gorm:row"),
+		"health:raw":    db.Callback().Raw().After("gorm:raw"),
+	} {
+		if err := processor.Register(name, callback); err != nil {
+			log.Fatalf("Failed to register database health callback: %v", err)
+		}
+	}
+}
+
+// isUnavailable tells connection problems apart from errors of a single query. A query running out of
+// its context's time is not an outage: one slow query must not put every client into 503 mode
+func isUnavailable(err error) bool {
+	var netErr net.Error
+	var connectErr *pgconn.ConnectError
+	var pgErr *pgconn.PgError
+
+	switch {
+	case errors.As(err, &connectErr):
+		return true
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, context.Canceled):
+		// checked before net.Error, which context.DeadlineExceeded implements
+		return false
+	case errors.Is(err, driver.ErrBadConn),
+		errors.Is(err, io.ErrUnexpectedEOF),
+		errors.As(err, &netErr):
+		return true
+	case errors.As(err, &pgErr):
+		// class 08 is connection exception, 53 insufficient resources, 57P0x server shutting down
+		return strings.HasPrefix(pgErr.Code, "08") || strings.HasPrefix(pgErr.Code, "53") || strings.HasPrefix(pgErr.Code, "57P0")
+	}
+	return false
+}
+
+// RequireDB answers 503 without touching the database while it is known to be down
+func RequireDB() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if healthy, _ := DBHealth.Healthy(); !healthy {
+			respondError(c, ErrDBUnavailable)
+			return
+		}
+
+		c.Next()
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5/pgconn"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	gormlogger "gorm.io/gorm/logger"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// failingDB is a game database nobody listens for: every query fails to connect
+func failingDB(t *testing.T) *gorm.DB {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().(*net.TCPAddr)
+	listener.Close()
+
+	dsn := fmt.Sprintf("host=127.0.0.1 port=%d user=game password=game dbname=game sslmode=disable connect_timeout=1", addr.Port)
+	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{DisableAutomaticPing: true, Logger: gormlogger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if sqlDB, err := db.DB(); err == nil {
+			sqlDB.Close()
+		}
+	})
+	return db
+}
+
+// connectionError is what a query against failingDB returns
+func connectionError(t *testing.T) error {
+	t.Helper()
+
+	err := failingDB(t).Exec("SELECT 1").Error
+	if err == nil {
+		t.Fatal("query against a closed port succeeded")
+	}
+	return err
+}
+
+// withDBHealth replaces DBHealth for the test. probing is set so no probe of GameDB starts
+func withDBHealth(t *testing.T, healthy bool) *dbHealth {
+	t.Helper()
+
+	previous := DBHealth
+	DBHealth = &dbHealth{healthy: healthy, probing: true}
+	t.Cleanup(func() { DBHealth = previous })
+	return DBHealth
+}
+
+func decodeProblem(t *testing.T, w *httptest.ResponseRecorder) Problem {
+	t.Helper()
+
+	var problem Problem
+	if err := json.Unmarshal(w.Body.Bytes(), &problem); err != nil {
+		t.Fatalf("response is not a problem: %v\n%s", err, w.Body)
+	}
+	return problem
+}
+
+func TestIsUnavailable(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"connection refused", connectionError(t), true},
+		{"bad connection", fmt.Errorf("query: %w", driver.ErrBadConn), true},
+		{"query deadline", fmt.Errorf("find players: %w", context.DeadlineExceeded), false},
+		{"request cancelled", fmt.Errorf("find players: %w", context.Canceled), false},
+		{"admin shutdown", &pgconn.PgError{Code: "57P01"}, true},
+		{"too many connections", &pgconn.PgError{Code: "53300"}, true},
+		{"connection failure", &pgconn.PgError{Code: "08006"}, true},
+		{"unique violation", &pgconn.PgError{Code: "23505"}, false},
+		{"not found", gorm.ErrRecordNotFound, false},
+		{"other", errors.New("boom"), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isUnavailable(tt.err); got != tt.want {
+				t.Errorf("isUnavailable(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDBHealthReport(t *testing.T) {
+	health := withDBHealth(t, true)
+
+	health.report(&pgconn.PgError{Code: "23505"})
+	if healthy, _ := health.Healthy(); !healthy {
+		t.Fatal("a failed query marked the database unreachable")
+	}
+
+	outage := connectionError(t)
+	health.report(outage)
+	healthy, err := health.Healthy()
+	if healthy || !errors.Is(err, outage) {
+		t.Fatalf("Healthy() = %v, %v after a connection error", healthy, err)
+	}
+
+	health.report(nil)
+	if healthy, err := health.Healthy(); !healthy || err != nil {
+		t.Fatalf("Healthy() = %v, %v after a successful query", healthy, err)
+	}
+}
+
+func TestProblemForUnavailable(t *testing.T) {
+	problem := problemFor(context.Background(), fmt.Errorf("find players: %w", connectionError(t)), "en")
+	if problem.Status != http.StatusServiceUnavailable || problem.Code != "db_unavailable" {
+		t.Errorf("connection error became %d %s, want 503 db_unavailable", problem.Status, problem.Code)
+	}
+
+	problem = problemFor(context.Background(), errors.New("boom"), "en")
+	if problem.Status != http.StatusInternalServerError || problem.Code != "internal" {
+		t.Errorf("unknown error became %d %s, want 500 internal", problem.Status, problem.Code)
+	}
+}
+
+func TestRequireDB(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	health := withDBHealth(t, true)
+
+	router := gin.New()
+	router.GET("/players", RequireDB(), func(c *gin.Context) { c.Status(http.StatusNoContent) })
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/players", nil))
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("healthy database: status %d, want 204", w.Code)
+	}
+
+	health.report(connectionError(t))
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/players", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("unreachable database: status %d, want 503", w.Code)
+	}
+	if got := w.Header().Get("Retry-After"); got != "5" {
+		t.Errorf("Retry-After = %q, want 5", got)
+	}
+	if problem := decodeProblem(t, w); problem.Code != "db_unavailable" {
+		t.Errorf("code = %q, want db_unavailable", problem.Code)
+	}
+}
+
+func TestGetPlayerWithFailingDatabase(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	withDBHealth(t, true)
+
+	previous := GameDB
+	GameDB = failingDB(t)
+	t.Cleanup(func() { GameDB = previous })
+
+	router := gin.New()
+	router.GET("/players/:login", GetPlayer)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/players/alice", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("status %d, want 503\n%s", w.Code, w.Body)
+	}
+	if w.Header().Get("Retry-After") == "" {
+		t.Error("no Retry-After on 503")
+	}
+	problem := decodeProblem(t, w)
+	if problem.Code != "db_unavailable" || problem.Instance != "/players/alice" {
+		t.Errorf("problem = %+v", problem)
+	}
+}
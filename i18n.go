@@ -0,0 +1,270 @@
+package main
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/text/language"
+	"sort"
+	"strings"
+)
+
+const defaultLanguage = "en"
+
+// languages are in matcher order: the first one is the fallback
+var (
+	languages       = []string{"en", "ro", "ru"}
+	languageMatcher = language.NewMatcher([]language.Tag{language.English, language.Romanian, language.Russian})
+)
+
+// catalogue maps language -> message key -> template. Error codes are keys as they are,
+// {name} placeholders are filled from the error's params
+var catalogue = map[string]map[string]string{
+	"en": {
+		"password_not_hashed":     "You gotta be kidding. Did you really just sent an unhashed password? 😂 Try SHA256",
+		"invalid_credentials":     "Invalid login or password",
+		"missing_token":           "Missing authorization cookie or bearer token",
+		"invalid_token":           "Invalid or expired token",
+		"session_revoked":         "Session has been revoked. Log in again",
+		"forbidden":               "Unauthorized access",
+		"admin_required":          "Admin access required",
+		"csrf_token_invalid":      "Missing or invalid CSRF token. Get one from /csrf",
+		"account_deactivated":     "Account is deactivated. You are no longer on the course",
+		"user_not_found":          "user not found",
+		"course_not_found":        "course not found",
+		"group_not_found":         "group not found",
+		"assignment_not_found":    "assignment not found",
+		"not_in_group":            "player is not in this group",
+		"export_not_found":        "export not found",
+		"export_not_ready":        "Export is not finished yet",
+		"group_exists":            "A group with this slug already exists",
+		"roster_empty":            "The roster has no entries",
+		"roster_import_disabled":  "Roster imports are only accepted when users come from an uploaded roster",
+		"too_many_login_attempts": "Too many failed login attempts. Try again later",
+		"rate_limited":            "Rate limit exceeded. Slow down",
+		"internal":                "Internal server error",
+		"db_unavailable":          "Database is unavailable. Try again later",
+		"player_exists":           "player with login {login} already exists",
+		"not_on_course":           "cannot register player with login {login}. No such user on course",
+		"player_not_found":        "player not found: {login}",
+		"roster_entry_invalid":    "roster entry {entry} needs a unique username, a name and, if given, a unique numeric tg_id",
+		"audit_tampered":          "audit log chain is broken at entry {id}",
+		"wrong_password":          "wrong password for player {login}",
+		"invalid_input":           "Invalid input",
+
+		"field.required":         "{field} is required",
+		"field.range":            "{field} must be between {min} and {max}",
+		"field.oneof":            "{field} must be one of {values}",
+		"field.rfc3339":          "{field} must be an RFC3339 timestamp",
+		"field.uint":             "{field} must be a non-negative integer",
+		"field.cursor":           "{field} is not a valid cursor for this sort order",
+		"field.type":             "{field} must be of type {type}",
+		"field.json":             "Request body is not valid JSON",
+		"field.csv":              "{field} is not CSV with a header row naming username and name",
+		"field.max":              "{field} must be at most {max} characters",
+		"field.after":            "{field} must be after {other}",
+		"field.required_without": "{field} or {other} is required",
+		"field.invalid":          "{field} failed the {rule} rule",
+
+		"message.login_success":        "success",
+		"message.password_changed":     "password changed",
+		"message.account_removed":      "account removed",
+		"message.unlocked":             "unlocked",
+		"message.password_reset":       "password reset",
+		"message.language_changed":     "language changed",
+		"message.group_deleted":        "group deleted",
+		"message.group_member_added":   "added to the group",
+		"message.group_member_removed": "removed from the group",
+		"message.assignment_deleted":   "assignment deleted",
+	},
+	"ro": {
+		"password_not_hashed":     "Glumești? Chiar ai trimis parola nehash-uită? 😂 Încearcă SHA256",
+		"invalid_credentials":     "Login sau parolă incorectă",
+		"missing_token":           "Lipsește cookie-ul de autorizare sau tokenul Bearer",
+		"invalid_token":           "Token invalid sau expirat",
+		"session_revoked":         "Sesiunea a fost revocată. Autentifică-te din nou",
+		"forbidden":               "Acces neautorizat",
+		"admin_required":          "Este necesar accesul de administrator",
+		"csrf_token_invalid":      "Token CSRF lipsă sau invalid. Obține unul de la /csrf",
+		"account_deactivated":     "Contul este dezactivat. Nu mai ești înscris la curs",
+		"user_not_found":          "utilizatorul nu a fost găsit",
+		"course_not_found":        "cursul nu a fost găsit",
+		"group_not_found":         "grupa nu a fost găsită",
+		"assignment_not_found":    "tema nu a fost găsită",
+		"not_in_group":            "jucătorul nu este în această grupă",
+		"export_not_found":        "exportul nu a fost găsit",
+		"export_not_ready":        "Exportul nu este încă gata",
+		"group_exists":            "Există deja o grupă cu acest identificator",
+		"roster_empty":            "Lista nu are nicio intrare",
+		"roster_import_disabled":  "Importul listei este acceptat doar când utilizatorii provin dintr-o listă încărcată",
+		"too_many_login_attempts": "Prea multe încercări eșuate de autentificare. Încearcă mai târziu",
+		"rate_limited":            "Limita de cereri a fost depășită. Încetinește",
+		"internal":                "Eroare internă a serverului",
+		"db_unavailable":          "Baza de date nu este disponibilă. Încearcă mai târziu",
+		"player_exists":           "jucătorul cu loginul {login} există deja",
+		"not_on_course":           "nu se poate înregistra jucătorul cu loginul {login}. Nu există un astfel de utilizator la curs",
+		"player_not_found":        "jucătorul nu a fost găsit: {login}",
+		"roster_entry_invalid":    "intrarea {entry} din listă are nevoie de un username unic, un nume și, dacă există, un tg_id numeric unic",
+		"audit_tampered":          "lanțul jurnalului de audit este rupt la intrarea {id}",
+		"wrong_password":          "parolă greșită pentru jucătorul {login}",
+		"invalid_input":           "Date de intrare invalide",
+
+		"field.required":         "{field} este obligatoriu",
+		"field.range":            "{field} trebuie să fie între {min} și {max}",
+		"field.oneof":            "{field} trebuie să fie unul dintre {values}",
+		"field.rfc3339":          "{field} trebuie să fie un moment de timp RFC3339",
+		"field.uint":             "{field} trebuie să fie un număr întreg nenegativ",
+		"field.cursor":           "{field} nu este un cursor valid pentru această ordine de sortare",
+		"field.type":             "{field} trebuie să fie de tipul {type}",
+		"field.json":             "Corpul cererii nu este JSON valid",
+		"field.csv":              "{field} nu este CSV cu un rând de antet care conține username și name",
+		"field.max":              "{field} trebuie să aibă cel mult {max} caractere",
+		"field.after":            "{field} trebuie să fie după {other}",
+		"field.required_without": "{field} sau {other} este obligatoriu",
+		"field.invalid":          "{field} nu respectă regula {rule}",
+
+		"message.login_success":        "succes",
+		"message.password_changed":     "parola a fost schimbată",
+		"message.account_removed":      "contul a fost șters",
+		"message.unlocked":             "deblocat",
+		"message.password_reset":       "parola a fost resetată",
+		"message.language_changed":     "limba a fost schimbată",
+		"message.group_deleted":        "grupa a fost ștearsă",
+		"message.group_member_added":   "adăugat în grupă",
+		"message.group_member_removed": "scos din grupă",
+		"message.assignment_deleted":   "tema a fost ștearsă",
+	},
+	"ru": {
+		"password_not_hashed":     "Ты шутишь? Ты правда отправил пароль без хеширования? 😂 Попробуй SHA256",
+		"invalid_credentials":     "Неверный логин или пароль",
+		"missing_token":           "Отсутствует cookie авторизации или Bearer-токен",
+		"invalid_token":           "Недействительный или просроченный токен",
+		"session_revoked":         "Сессия отозвана. Войдите снова",
+		"forbidden":               "Доступ запрещён",
+		"admin_required":          "Требуются права администратора",
+		"csrf_token_invalid":      "CSRF-токен отсутствует или недействителен. Получите его через /csrf",
+		"account_deactivated":     "Аккаунт деактивирован. Вы больше не записаны на курс",
+		"user_not_found":          "пользователь не найден",
+		"course_not_found":        "курс не найден",
+		"group_not_found":         "группа не найдена",
+		"assignment_not_found":    "задание не найдено",
+		"not_in_group":            "игрок не состоит в этой группе",
+		"export_not_found":        "экспорт не найден",
+		"export_not_ready":        "Экспорт ещё не готов",
+		"group_exists":            "Группа с таким идентификатором уже существует",
+		"roster_empty":            "В списке нет ни одной записи",
+		"roster_import_disabled":  "Импорт списка доступен, только когда пользователи берутся из загруженного списка",
+		"too_many_login_attempts": "Слишком много неудачных попыток входа. Попробуйте позже",
+		"rate_limited":            "Превышен лимит запросов. Помедленнее",
+		"internal":                "Внутренняя ошибка сервера",
+		"db_unavailable":          "База данных недоступна. Попробуйте позже",
+		"player_exists":           "игрок с логином {login} уже существует",
+		"not_on_course":           "нельзя зарегистрировать игрока с логином {login}. Такого пользователя нет на курсе",
+		"player_not_found":        "игрок не найден: {login}",
+		"roster_entry_invalid":    "записи {entry} в списке нужны уникальный username, имя и, если указан, уникальный числовой tg_id",
+		"audit_tampered":          "цепочка журнала аудита нарушена на записи {id}",
+		"wrong_password":          "неверный пароль для игрока {login}",
+		"invalid_input":           "Некорректные данные",
+
+		"field.required":         "{field} обязательно",
+		"field.range":            "{field} должно быть от {min} до {max}",
+		"field.oneof":            "{field} должно быть одним из: {values}",
+		"field.rfc3339":          "{field} должно быть временной меткой RFC3339",
+		"field.uint":             "{field} должно быть неотрицательным целым числом",
+		"field.cursor":           "{field} не является допустимым курсором для этого порядка сортировки",
+		"field.type":             "{field} должно иметь тип {type}",
+		"field.json":             "Тело запроса не является корректным JSON",
+		"field.csv":              "{field} не является CSV со строкой заголовка, содержащей username и name",
+		"field.max":              "{field} должно быть не длиннее {max} символов",
+		"field.after":            "{field} должно быть позже {other}",
+		"field.required_without": "нужно указать {field} или {other}",
+		"field.invalid":          "{field} не проходит правило {rule}",
+
+		"message.login_success":        "успешно",
+		"message.password_changed":     "пароль изменён",
+		"message.account_removed":      "аккаунт удалён",
+		"message.unlocked":             "разблокировано",
+		"message.password_reset":       "пароль сброшен",
+		"message.language_changed":     "язык изменён",
+		"message.group_deleted":        "группа удалена",
+		"message.group_member_added":   "добавлен в группу",
+		"message.group_member_removed": "удалён из группы",
+		"message.assignment_deleted":   "задание удалено",
+	},
+}
+
+// translate fills the template of key in lang, falling back to English for unknown languages and keys
+func translate(lang, key string, params map[string]string) string {
+	template, ok := catalogue[lang][key]
+	if !ok {
+		template, ok = catalogue[defaultLanguage][key]
+	}
+	if !ok {
+		return key
+	}
+
+	if len(params) == 0 {
+		return template
+	}
+
+	replacements := make([]string, 0, 2*len(params))
+	for name, value := range params {
+		replacements = append(replacements, "{"+name+"}", value)
+	}
+	return strings.NewReplacer(replacements...).Replace(template)
+}
+
+// validateCatalogue makes sure every language translates exactly the keys English has
+func validateCatalogue() error {
+	var problems []string
+
+	for _, lang := range languages {
+		for key := range catalogue[defaultLanguage] {
+			if _, ok := catalogue[lang][key]; !ok {
+				problems = append(problems, fmt.Sprintf("%s is missing %q", lang, key))
+			}
+		}
+		for key := range catalogue[lang] {
+			if _, ok := catalogue[defaultLanguage][key]; !ok {
+				problems = append(problems, fmt.Sprintf("%s has unknown key %q", lang, key))
+			}
+		}
+	}
+
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return fmt.Errorf("message catalogue is incomplete: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+func isSupportedLanguage(lang string) bool {
+	_, ok := catalogue[lang]
+	return ok
+}
+
+// requestLanguage picks the logged-in player's preference, then Accept-Language, then English
+func requestLanguage(c *gin.Context) string {
+	if lang := c.GetString("language"); lang != "" {
+		return lang
+	}
+
+	lang := ""
+	if claims, ok := c.Get("claims"); ok {
+		if player, err := GetPlayerByLogin(c.Request.Context(), claims.(*JWTClaims).Login); err == nil && isSupportedLanguage(player.Language) {
+			lang = player.Language
+		}
+	}
+
+	if lang == "" {
+		_, index := language.MatchStrings(languageMatcher, c.GetHeader("Accept-Language"))
+		lang = languages[index]
+	}
+
+	c.Set("language", lang)
+	return lang
+}
+
+// message translates a success message for the current request
+func message(c *gin.Context, key string) string {
+	return translate(requestLanguage(c), "message."+key, nil)
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"strconv"
+	"testing"
+)
+
+func TestCatalogueIsComplete(t *testing.T) {
+	if err := validateCatalogue(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// errorCodes collects the code of every APIError literal and every Code method in err.go,
+// so a new error cannot be added without its messages
+func errorCodes(t *testing.T) []string {
+	t.Helper()
+
+	file, err := parser.ParseFile(token.NewFileSet(), "err.go", nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var codes []string
+	addCode := func(expr ast.Expr) {
+		literal, ok := expr.(*ast.BasicLit)
+		if !ok || literal.Kind != token.STRING {
+			return
+		}
+		if code, err := strconv.Unquote(literal.Value); err == nil {
+			codes = append(codes, code)
+		}
+	}
+
+	ast.Inspect(file, func(node ast.Node) bool {
+		switch n := node.(type) {
+		case *ast.CompositeLit:
+			if ident, ok := n.Type.(*ast.Ident); ok && ident.Name == "APIError" && len(n.Elts) == 2 {
+				addCode(n.Elts[1])
+			}
+		case *ast.FuncDecl:
+			if n.Recv != nil && n.Name.Name == "Code" && len(n.Body.List) == 1 {
+				if ret, ok := n.Body.List[0].(*ast.ReturnStmt); ok && len(ret.Results) == 1 {
+					addCode(ret.Results[0])
+				}
+			}
+		}
+		return true
+	})
+	return codes
+}
+
+func TestEveryErrorCodeIsTranslated(t *testing.T) {
+	codes := errorCodes(t)
+	if len(codes) < 20 {
+		t.Fatalf("found only %d error codes in err.go: %v", len(codes), codes)
+	}
+
+	for _, code := range codes {
+		for _, lang := range languages {
+			if _, ok := catalogue[lang][code]; !ok {
+				t.Errorf("%s has no message for error code %q", lang, code)
+			}
+		}
+	}
+}
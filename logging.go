@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"regexp"
+	"runtime/debug"
+	"strings"
+	"time"
+)
+
+const requestIDHeader = "X-Request-ID"
+
+// maxLoggedBody caps how much of a request body debug logging reads
+const maxLoggedBody = 4 << 10
+
+const redacted = "[REDACTED]"
+
+// sensitiveKeys never reach the log with their value, whether they are log attributes, headers or JSON fields
+var sensitiveKeys = map[string]bool{
+	"password":      true,
+	"old_password":  true,
+	"new_password":  true,
+	"token":         true,
+	"authorization": true,
+	"cookie":        true,
+	"set-cookie":    true,
+	"csrf_token":    true,
+	"x-csrf-token":  true,
+}
+
+// jwtPattern catches tokens that slip into free text, like a URL or an error message
+var jwtPattern = regexp.MustCompile(`eyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]*`)
+
+// requestIDPattern accepts incoming IDs that are safe to echo back and write into logs
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+type loggerKey struct{}
+
+func isSensitive(key string) bool {
+	return sensitiveKeys[strings.ToLower(key)]
+}
+
+// initLogging installs the JSON or text slog logger at the configured level (debug, info, warn or error).
+// The log package writes through it too. Logs go to stderr so CLI commands can keep stdout for their output
+func initLogging(cfg LogConfig) error {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(cfg.Level)); err != nil {
+		return fmt.Errorf("invalid log level %q: %w", cfg.Level, err)
+	}
+
+	options := &slog.HandlerOptions{Level: level, ReplaceAttr: redactAttr}
+
+	var handler slog.Handler
+	switch format := cfg.Format; format {
+	case "json":
+		handler = slog.NewJSONHandler(os.Stderr, options)
+	case "text":
+		handler = slog.NewTextHandler(os.Stderr, options)
+	default:
+		return fmt.Errorf("invalid log format %q, use json or text", format)
+	}
+
+	slog.SetDefault(slog.New(handler))
+	gin.DefaultWriter = io.Discard // the access log below replaces gin's
+	return nil
+}
+
+// redactAttr hides sensitive attributes and JWTs inside any string value
+func redactAttr(_ []string, attr slog.Attr) slog.Attr {
+	if isSensitive(attr.Key) {
+		return slog.String(attr.Key, redacted)
+	}
+	if attr.Value.Kind() == slog.KindString {
+		attr.Value = slog.StringValue(jwtPattern.ReplaceAllString(attr.Value.String(), redacted))
+	}
+	return attr
+}
+
+// logger returns the logger of the request ctx belongs to, carrying its request and trace IDs
+func logger(ctx context.Context) *slog.Logger {
+	if l, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return l
+	}
+	return slog.Default()
+}
+
+func newRequestID() string {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(id)
+}
+
+// RequestLogging gives every request an ID, taken from X-Request-ID when the caller sent a sane one,
+// puts a logger carrying it into the request context and writes one access log line per request
+func RequestLogging() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+
+		requestID := c.GetHeader(requestIDHeader)
+		if !requestIDPattern.MatchString(requestID) {
+			requestID = newRequestID()
+		}
+		c.Set("requestID", requestID)
+		c.Header(requestIDHeader, requestID)
+
+		attrs := []any{slog.String("request_id", requestID)}
+		if id := traceID(c.Request.Context()); id != "" {
+			attrs = append(attrs, slog.String("trace_id", id))
+		}
+		l := slog.Default().With(attrs...)
+		c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), loggerKey{}, l))
+
+		if l.Enabled(c.Request.Context(), slog.LevelDebug) {
+			l.Debug("request received",
+				slog.String("method", c.Request.Method),
+				slog.String("path", c.Request.URL.Path),
+				slog.Any("headers", redactHeaders(c.Request.Header)),
+				slog.String("body", peekBody(c.Request)))
+		}
+
+		c.Next()
+
+		status := c.Writer.Status()
+		level := slog.LevelInfo
+		switch {
+		case status >= 500:
+			level = slog.LevelError
+		case status >= 400:
+			level = slog.LevelWarn
+		}
+
+		fields := []any{
+			slog.String("method", c.Request.Method),
+			slog.String("route", c.FullPath()),
+			slog.String("path", c.Request.URL.Path),
+			slog.Int("status", status),
+			slog.Float64("latency_ms", float64(time.Since(start).Microseconds())/1000),
+			slog.String("ip", c.ClientIP()),
+			slog.Int("bytes", c.Writer.Size()),
+		}
+		if claims, ok := c.Get("claims"); ok {
+			fields = append(fields, slog.String("login", claims.(*JWTClaims).Login))
+		}
+		if len(c.Errors) > 0 {
+			fields = append(fields, slog.String("errors", c.Errors.String()))
+		}
+
+		l.Log(c.Request.Context(), level, "request", fields...)
+	}
+}
+
+// Recovery turns a panic into a logged stack trace and a problem response
+func Recovery() gin.HandlerFunc {
+	return gin.CustomRecoveryWithWriter(io.Discard, func(c *gin.Context, recovered any) {
+		logger(c.Request.Context()).Error("panic while handling request",
+			slog.Any("panic", recovered),
+			slog.String("stack", string(debug.Stack())))
+		respondError(c, ErrInternal)
+	})
+}
+
+func requestID(c *gin.Context) string {
+	return c.GetString("requestID")
+}
+
+// redactHeaders copies the headers with credentials blanked out
+func redactHeaders(headers http.Header) map[string]string {
+	result := make(map[string]string, len(headers))
+	for name, values := range headers {
+		if isSensitive(name) {
+			result[name] = redacted
+		} else {
+			result[name] = strings.Join(values, ", ")
+		}
+	}
+	return result
+}
+
+// peekBody reads the start of a JSON body for logging and puts it back for the handler
+func peekBody(r *http.Request) string {
+	if r.Body == nil || !strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		return ""
+	}
+
+	head, err := io.ReadAll(io.LimitReader(r.Body, maxLoggedBody))
+	r.Body = readCloser{io.MultiReader(bytes.NewReader(head), r.Body), r.Body}
+	if err != nil {
+		return ""
+	}
+	return redactJSON(head)
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// redactJSON blanks sensitive fields at any depth. Bodies that are not valid JSON (or were cut off)
+// are not logged at all, there is no telling what they contain
+func redactJSON(body []byte) string {
+	var value any
+	if err := json.Unmarshal(body, &value); err != nil {
+		return "[unparsable body omitted]"
+	}
+
+	encoded, err := json.Marshal(redactValue(value))
+	if err != nil {
+		return ""
+	}
+	return string(encoded)
+}
+
+func redactValue(value any) any {
+	switch v := value.(type) {
+	case map[string]any:
+		for key, item := range v {
+			if isSensitive(key) {
+				v[key] = redacted
+			} else {
+				v[key] = redactValue(item)
+			}
+		}
+	case []any:
+		for i, item := range v {
+			v[i] = redactValue(item)
+		}
+	case string:
+		return jwtPattern.ReplaceAllString(v, redacted)
+	}
+	return value
+}
@@ -1,14 +1,21 @@
 package main
 
 import (
-	"github.com/joho/godotenv"
+	"context"
 	"gorm.io/gorm"
 	"log"
+	"log/slog"
 	"os"
-	"strconv"
+	"os/signal"
+	"syscall"
 )
 
-var BotDB *gorm.DB
+var (
+	// GameDB holds everything this API owns
+	GameDB *gorm.DB
+	// UsersDB is the Telegram bot's database, read through Users only
+	UsersDB *gorm.DB
+)
 
 // @title           Player API
 // @version         1.0
@@ -17,22 +24,66 @@ var BotDB *gorm.DB
 // @BasePath  /
 // @schemes https
 func main() {
-	err := godotenv.Load(".env")
+	cfg, args, err := loadConfig(os.Args[1:])
 	if err != nil {
-		log.Fatalf("Error loading .env file: %s", err)
+		log.Fatalf("Invalid configuration:\n%s", err)
 	}
 
-	botDBHost := os.Getenv("BOT_DB_HOST")
-	botDBName := os.Getenv("BOT_DB_NAME")
-	botDBUser := os.Getenv("BOT_DB_USER")
-	botDBPass := os.Getenv("BOT_DB_PASS")
+	if err := initLogging(cfg.Log); err != nil {
+		log.Fatal(err)
+	}
+	slog.Info("configuration loaded", slog.Any("config", cfg))
 
-	botDBPort, err := strconv.Atoi(os.Getenv("BOT_DB_PORT"))
-	if err != nil {
+	jwtSecret = []byte(cfg.JWTSecret)
+	tokenExpiry = cfg.TokenExpiry
+
+	GameDB = initDB(cfg.DB)
+	UsersDB = initUsersDB(cfg.UsersDB)
+
+	defaultUserDirectory = cfg.Users.Directory
+	Users = newUserDirectory(cfg.Users)
+	rosterDeactivateRemoved = cfg.Users.DeactivateRemoved
+	gradeThresholds = cfg.Grades.Thresholds
+	sortGradeThresholds(gradeThresholds)
+
+	if cfg.LoginAttemptStore == "db" {
+		LoginAttempts = NewDBAttemptStore(GameDB)
+	}
+
+	if len(args) > 0 {
+		os.Exit(runCommand(cfg, args))
+	}
+
+	if cfg.DB.MigrateOnStart {
+		applied, err := MigrateUp(context.Background(), GameDB)
+		if err != nil {
+			log.Fatalf("Failed to migrate the database: %v", err)
+		}
+		for _, migration := range applied {
+			slog.Info("migration applied", slog.Int("version", migration.Version), slog.String("name", migration.Name))
+		}
+	}
+
+	if err := checkSchema(context.Background(), GameDB); err != nil {
 		log.Fatal(err)
 	}
 
-	BotDB = initDB(botDBHost, botDBName, botDBUser, botDBPass, botDBPort)
+	shutdownTracing, err := initTracing(context.Background(), cfg.Tracing.Exporter)
+	if err != nil {
+		log.Fatalf("Failed to set up tracing: %s", err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	err = serve(ctx, cfg, newRouter(cfg))
 
-	initAPI(8080)
+	// spans of the last requests are flushed after they were drained
+	if tracingErr := shutdownTracing(context.Background()); tracingErr != nil {
+		slog.Error("failed to flush traces", slog.Any("error", tracingErr))
+	}
+	if err != nil {
+		slog.Error("server stopped with an error", slog.Any("error", err))
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"gorm.io/gorm"
+	"log"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const metricsNamespace = "memorygame"
+
+// metricsRegistry holds our metrics only, the default registry would pick up whatever libraries register
+var metricsRegistry = prometheus.NewRegistry()
+
+var (
+	httpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "http_requests_total",
+		Help:      "HTTP requests by route pattern, method and status code.",
+	}, []string{"method", "route", "status"})
+
+	httpDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "HTTP request latency by route pattern, method and status code.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "route", "status"})
+
+	dbQueryDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "db_query_duration_seconds",
+		Help:      "Database statement latency by gorm operation and outcome.",
+		Buckets:   []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5},
+	}, []string{"operation", "result"})
+
+	registrations = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "registrations_total",
+		Help:      "Players registered.",
+	})
+
+	logins = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "logins_total",
+		Help:      "Login attempts by result: success, failure or locked.",
+	}, []string{"result"})
+
+	scoreImprovements = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "score_improvements_total",
+		Help:      "Submitted scores that beat the player's best.",
+	})
+
+	rosterChanges = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "roster_changes_total",
+		Help:      "Course users the roster sync added, renamed, removed or restored.",
+	}, []string{"change"})
+)
+
+func init() {
+	metricsRegistry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		httpRequests, httpDuration, dbQueryDuration,
+		registrations, logins, scoreImprovements, rosterChanges,
+	)
+
+	// pre-create the label sets so dashboards see zeros instead of missing series
+	for _, result := range []string{"success", "failure", "locked"} {
+		logins.WithLabelValues(result)
+	}
+	for _, change := range []string{"added", "renamed", "removed", "restored"} {
+		rosterChanges.WithLabelValues(change)
+	}
+}
+
+// Metrics records count and latency of every request, labelled with the route pattern
+// rather than the path so /players/:login does not explode into one series per player
+func Metrics() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		status := strconv.Itoa(c.Writer.Status())
+
+		httpRequests.WithLabelValues(c.Request.Method, route, status).Inc()
+		httpDuration.WithLabelValues(c.Request.Method, route, status).Observe(time.Since(start).Seconds())
+	}
+}
+
+// registerMetricsCallbacks times every gorm operation and exports the connection pool stats
+func registerMetricsCallbacks(db *gorm.DB, name string) {
+	sqlDB, err := db.DB()
+	if err != nil {
+		log.Fatalf("Failed to get database handle for metrics: %v", err)
+	}
+	metricsRegistry.MustRegister(collectors.NewDBStatsCollector(sqlDB, name))
+
+	before := func(tx *gorm.DB) {
+		tx.InstanceSet("metrics:start", time.Now())
+	}
+	after := func(operation string) func(*gorm.DB) {
+		return func(tx *gorm.DB) {
+			start, ok := tx.InstanceGet("metrics:start")
+			if !ok {
+				return
+			}
+
+			result := "ok"
+			if tx.Error != nil && !errors.Is(tx.Error, gorm.ErrRecordNotFound) {
+				result = "error"
+			}
+			dbQueryDuration.WithLabelValues(operation, result).Observe(time.Since(start.(time.Time)).Seconds())
+		}
+	}
+
+	callbacks := db.Callback()
+	err = errors.Join(
+		callbacks.Create().Before("gorm:create").Register("metrics:create:start", before),
+		callbacks.Create().After("gorm:create").Register("metrics:create", after("create")),
+		callbacks.Query().Before("gorm:query").Register("metrics:query:start", before),
+		callbacks.Query().After("gorm:query").Register("metrics:query", after("query")),
+		callbacks.Update().Before("gorm:update").Register("metrics:update:start", before),
+		callbacks.Update().After("gorm:update").Register("metrics:update", after("update")),
+		callbacks.Delete().Before("gorm:delete").Register("metrics:delete:start", before),
+		callbacks.Delete().After("gorm:delete").Register("metrics:delete", after("delete")),
+		callbacks.Row().Before("gorm:row").Register("metrics:row:start", before),
+		callbacks.Row().After("gorm:row").Register("metrics:row", after("row")),
+		callbacks.Raw().Before("gorm:raw").Register("metrics:raw:start", before),
+		callbacks.Raw().After("gorm:raw").Register("metrics:raw", after("raw")),
+	)
+	if err != nil {
+		log.Fatalf("Failed to register database metrics callbacks: %v", err)
+	}
+}
+
+// metricsHandler serves the registry. With a token configured, scrapers must send it as a bearer token
+func metricsHandler(token string) gin.HandlerFunc {
+	handler := promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{})
+
+	return func(c *gin.Context) {
+		if token != "" {
+			got, ok := bearerToken(c)
+			if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+				c.Header("WWW-Authenticate", `Bearer realm="metrics"`)
+				c.AbortWithStatus(http.StatusUnauthorized)
+				return
+			}
+		}
+
+		handler.ServeHTTP(c.Writer, c.Request)
+	}
+}
+
+// mountMetrics exposes /metrics as configured. By default it is not served at all:
+// an address (METRICS_ADDR, e.g. 127.0.0.1:9090) gets a separate listener for scrapers on a private network,
+// see newMetricsServer, a token (METRICS_TOKEN) protects it with a bearer token and, without an address,
+// mounts it on the public router
+func mountMetrics(router *gin.Engine, cfg MetricsConfig) {
+	switch {
+	case cfg.Addr != "":
+	case cfg.Token != "":
+		router.GET("/metrics", metricsHandler(cfg.Token))
+	default:
+		slog.Info("metrics are disabled, set METRICS_ADDR or METRICS_TOKEN to expose /metrics")
+	}
+}
+
+// newMetricsServer returns the private metrics listener, or nil without a metrics address
+func newMetricsServer(cfg Config) *http.Server {
+	if cfg.Metrics.Addr == "" {
+		return nil
+	}
+
+	router := gin.New()
+	router.Use(Recovery())
+	router.GET("/metrics", metricsHandler(cfg.Metrics.Token))
+
+	return newHTTPServer(cfg.Metrics.Addr, router, cfg.Server)
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"embed"
+	"fmt"
+	"gorm.io/gorm"
+	"io/fs"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+)
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// migrationLockKey serializes migrations across replicas starting at the same time
+const migrationLockKey = 260043
+
+var migrationName = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+// Migration is one schema change, read from migrations/<version>_<name>.up.sql and its .down.sql
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// SchemaMigration records an applied migration
+type SchemaMigration struct {
+	Version   int       `gorm:"primarykey;autoIncrement:false"`
+	Name      string    `gorm:"not null"`
+	AppliedAt time.Time `gorm:"not null"`
+}
+
+type MigrationState struct {
+	Migration
+	AppliedAt *time.Time
+}
+
+// SchemaMismatchError means the database is not at the version this binary was built for
+type SchemaMismatchError struct {
+	Current, Expected int
+}
+
+func (e *SchemaMismatchError) Error() string {
+	if e.Current > e.Expected {
+		return fmt.Sprintf("database schema is at version %d, newer than the %d this build knows. Deploy a newer build or run migrate down with one", e.Current, e.Expected)
+	}
+	return fmt.Sprintf("database schema is at version %d, this build needs %d. Run migrate up", e.Current, e.Expected)
+}
+
+// loadMigrations returns the embedded migrations ordered by version
+func loadMigrations() ([]Migration, error) {
+	entries, err := fs.ReadDir(migrationFiles, "migrations")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := map[int]*Migration{}
+	for _, entry := range entries {
+		match := migrationName.FindStringSubmatch(entry.Name())
+		if match == nil {
+			return nil, fmt.Errorf("migration file %s does not look like 0001_name.up.sql", entry.Name())
+		}
+
+		version, _ := strconv.Atoi(match[1])
+		migration, ok := byVersion[version]
+		if !ok {
+			migration = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = migration
+		} else if migration.Name != match[2] {
+			return nil, fmt.Errorf("migration %d is named both %s and %s", version, migration.Name, match[2])
+		}
+
+		sql, err := migrationFiles.ReadFile("migrations/" + entry.Name())
+		if err != nil {
+			return nil, err
+		}
+		if match[3] == "up" {
+			migration.Up = string(sql)
+		} else {
+			migration.Down = string(sql)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, migration := range byVersion {
+		if migration.Up == "" || migration.Down == "" {
+			return nil, fmt.Errorf("migration %d_%s needs both an up and a down file", migration.Version, migration.Name)
+		}
+		migrations = append(migrations, *migration)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+
+	for i, migration := range migrations {
+		if migration.Version != i+1 {
+			return nil, fmt.Errorf("migration versions must count up from 1 without gaps, found %d at position %d", migration.Version, i+1)
+		}
+	}
+	return migrations, nil
+}
+
+func ensureMigrationTable(db *gorm.DB) error {
+	return db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version    bigint PRIMARY KEY,
+		name       text        NOT NULL,
+		applied_at timestamptz NOT NULL
+	)`).Error
+}
+
+// schemaVersion is the highest applied migration, 0 on a database that was never migrated
+func schemaVersion(db *gorm.DB) (int, error) {
+	var version int
+	err := db.Model(&SchemaMigration{}).Select("COALESCE(MAX(version), 0)").Scan(&version).Error
+	return version, err
+}
+
+// inMigrationLock runs fn in a transaction holding the migration lock, so of two replicas
+// the second one waits and then sees the first one's work
+func inMigrationLock(ctx context.Context, db *gorm.DB, fn func(tx *gorm.DB) error) error {
+	return db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec("SELECT pg_advisory_xact_lock(?)", migrationLockKey).Error; err != nil {
+			return err
+		}
+		if err := ensureMigrationTable(tx); err != nil {
+			return err
+		}
+		return fn(tx)
+	})
+}
+
+// MigrateUp applies every pending migration, each in its own transaction, and returns the applied ones
+func MigrateUp(ctx context.Context, db *gorm.DB) ([]Migration, error) {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return nil, err
+	}
+
+	var applied []Migration
+	for _, migration := range migrations {
+		err := inMigrationLock(ctx, db, func(tx *gorm.DB) error {
+			version, err := schemaVersion(tx)
+			if err != nil || version >= migration.Version {
+				return err
+			}
+
+			if err := tx.Exec(migration.Up).Error; err != nil {
+				return fmt.Errorf("migration %d_%s: %w", migration.Version, migration.Name, err)
+			}
+			if err := tx.Create(&SchemaMigration{Version: migration.Version, Name: migration.Name, AppliedAt: time.Now()}).Error; err != nil {
+				return err
+			}
+			applied = append(applied, migration)
+			return nil
+		})
+		if err != nil {
+			return applied, err
+		}
+	}
+	return applied, nil
+}
+
+// MigrateDown reverts the last steps migrations, newest first, and returns the reverted ones
+func MigrateDown(ctx context.Context, db *gorm.DB, steps int) ([]Migration, error) {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return nil, err
+	}
+
+	var reverted []Migration
+	for i := 0; i < steps; i++ {
+		done := false
+		err := inMigrationLock(ctx, db, func(tx *gorm.DB) error {
+			version, err := schemaVersion(tx)
+			if err != nil {
+				return err
+			}
+			if version == 0 {
+				done = true
+				return nil
+			}
+			if version > len(migrations) {
+				return &SchemaMismatchError{Current: version, Expected: len(migrations)}
+			}
+
+			migration := migrations[version-1]
+			if err := tx.Exec(migration.Down).Error; err != nil {
+				return fmt.Errorf("reverting migration %d_%s: %w", migration.Version, migration.Name, err)
+			}
+			if err := tx.Delete(&SchemaMigration{}, migration.Version).Error; err != nil {
+				return err
+			}
+			reverted = append(reverted, migration)
+			return nil
+		})
+		if err != nil || done {
+			return reverted, err
+		}
+	}
+	return reverted, nil
+}
+
+// MigrationStatus lists every known migration and when it was applied
+func MigrationStatus(ctx context.Context, db *gorm.DB) ([]MigrationState, error) {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := ensureMigrationTable(db.WithContext(ctx)); err != nil {
+		return nil, err
+	}
+
+	var records []SchemaMigration
+	if err := db.WithContext(ctx).Order("version").Find(&records).Error; err != nil {
+		return nil, err
+	}
+	appliedAt := make(map[int]time.Time, len(records))
+	for _, record := range records {
+		appliedAt[record.Version] = record.AppliedAt
+	}
+
+	states := make([]MigrationState, len(migrations))
+	for i, migration := range migrations {
+		states[i].Migration = migration
+		if at, ok := appliedAt[migration.Version]; ok {
+			states[i].AppliedAt = &at
+		}
+	}
+	return states, nil
+}
+
+// checkSchema refuses to run against a database that is behind or ahead of this build
+func checkSchema(ctx context.Context, db *gorm.DB) error {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return err
+	}
+
+	if err := ensureMigrationTable(db.WithContext(ctx)); err != nil {
+		return err
+	}
+
+	version, err := schemaVersion(db.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	if version != len(migrations) {
+		return &SchemaMismatchError{Current: version, Expected: len(migrations)}
+	}
+	return nil
+}
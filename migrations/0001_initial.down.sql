@@ -0,0 +1,7 @@
+DROP TABLE IF EXISTS export_jobs;
+DROP TABLE IF EXISTS sessions;
+DROP TABLE IF EXISTS rate_buckets;
+DROP TABLE IF EXISTS login_attempts;
+DROP TABLE IF EXISTS audit_entries;
+DROP TABLE IF EXISTS score_records;
+DROP TABLE IF EXISTS players;
@@ -0,0 +1,79 @@
+-- Baseline: the schema AutoMigrate used to create. Tables are created only when
+-- missing, and columns added after the first release are added to players when
+-- missing, so databases that AutoMigrate set up end up with the same schema.
+-- The users table belongs to the Telegram bot database and is not created here.
+
+CREATE TABLE IF NOT EXISTS players (
+    id         bigserial PRIMARY KEY,
+    created_at timestamptz,
+    updated_at timestamptz,
+    deleted_at timestamptz,
+    login      text    NOT NULL UNIQUE,
+    password   text    NOT NULL,
+    score      bigint  NOT NULL DEFAULT 0,
+    is_admin   boolean NOT NULL DEFAULT false,
+    language   text    NOT NULL DEFAULT ''
+);
+ALTER TABLE players ADD COLUMN IF NOT EXISTS is_admin boolean NOT NULL DEFAULT false;
+ALTER TABLE players ADD COLUMN IF NOT EXISTS language text NOT NULL DEFAULT '';
+CREATE INDEX IF NOT EXISTS idx_players_deleted_at ON players (deleted_at);
+
+CREATE TABLE IF NOT EXISTS score_records (
+    id         bigserial PRIMARY KEY,
+    created_at timestamptz,
+    player_id  bigint NOT NULL,
+    score      bigint NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_score_records_created_at ON score_records (created_at);
+CREATE INDEX IF NOT EXISTS idx_score_records_player_id ON score_records (player_id);
+
+CREATE TABLE IF NOT EXISTS audit_entries (
+    id         bigserial PRIMARY KEY,
+    created_at timestamptz NOT NULL,
+    event      text        NOT NULL,
+    login      text,
+    actor      text,
+    ip         text,
+    user_agent text,
+    details    text,
+    prev_hash  text        NOT NULL,
+    hash       text        NOT NULL UNIQUE
+);
+CREATE INDEX IF NOT EXISTS idx_audit_entries_created_at ON audit_entries (created_at);
+CREATE INDEX IF NOT EXISTS idx_audit_entries_event ON audit_entries (event);
+CREATE INDEX IF NOT EXISTS idx_audit_entries_login ON audit_entries (login);
+
+CREATE TABLE IF NOT EXISTS login_attempts (
+    key          text PRIMARY KEY,
+    failures     bigint      NOT NULL DEFAULT 0,
+    last_failure timestamptz NOT NULL,
+    locked_until timestamptz
+);
+
+CREATE TABLE IF NOT EXISTS rate_buckets (
+    key        text PRIMARY KEY,
+    tokens     decimal     NOT NULL,
+    updated_at timestamptz NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS sessions (
+    id         text PRIMARY KEY,
+    login      text        NOT NULL,
+    ip         text,
+    user_agent text,
+    created_at timestamptz,
+    expires_at timestamptz NOT NULL,
+    revoked_at timestamptz
+);
+CREATE INDEX IF NOT EXISTS idx_sessions_login ON sessions (login);
+
+CREATE TABLE IF NOT EXISTS export_jobs (
+    id          text PRIMARY KEY,
+    login       text NOT NULL,
+    status      text NOT NULL,
+    error       text,
+    archive     bytea,
+    created_at  timestamptz,
+    finished_at timestamptz
+);
+CREATE INDEX IF NOT EXISTS idx_export_jobs_login ON export_jobs (login);
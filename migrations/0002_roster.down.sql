@@ -0,0 +1,3 @@
+ALTER TABLE players DROP COLUMN deactivated_at;
+ALTER TABLE players DROP COLUMN tg_id;
+DROP TABLE roster_users;
@@ -0,0 +1,15 @@
+-- local copy of the course users, kept up to date by the roster sync job
+CREATE TABLE roster_users (
+    id         bigserial PRIMARY KEY,
+    tg_id      bigint      NOT NULL UNIQUE,
+    username   text        NOT NULL,
+    name       text        NOT NULL,
+    active     boolean     NOT NULL DEFAULT true,
+    synced_at  timestamptz NOT NULL,
+    removed_at timestamptz
+);
+CREATE INDEX idx_roster_users_username ON roster_users (username);
+
+-- the Telegram account a player belongs to, it survives username changes
+ALTER TABLE players ADD COLUMN tg_id bigint UNIQUE;
+ALTER TABLE players ADD COLUMN deactivated_at timestamptz;
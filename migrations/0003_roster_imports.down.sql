@@ -0,0 +1,2 @@
+DELETE FROM roster_users WHERE tg_id IS NULL;
+ALTER TABLE roster_users ALTER COLUMN tg_id SET NOT NULL;
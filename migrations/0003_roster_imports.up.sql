@@ -0,0 +1,2 @@
+-- imported rosters may not know the Telegram ID, those users are matched by username
+ALTER TABLE roster_users ALTER COLUMN tg_id DROP NOT NULL;
@@ -0,0 +1,21 @@
+-- only the default course survives, the others cannot be folded into one namespace.
+-- audit_entries keeps its course column: the hashes of other courses' entries include it
+DELETE FROM export_jobs WHERE course_id <> 1;
+DELETE FROM sessions WHERE course_id <> 1;
+DELETE FROM roster_users WHERE course_id <> 1;
+DELETE FROM score_records WHERE player_id IN (SELECT id FROM players WHERE course_id <> 1);
+DELETE FROM players WHERE course_id <> 1;
+
+DROP INDEX idx_sessions_course_login;
+DROP INDEX idx_roster_users_course_tg_id;
+ALTER TABLE roster_users ADD CONSTRAINT roster_users_tg_id_key UNIQUE (tg_id);
+DROP INDEX idx_players_course_tg_id;
+ALTER TABLE players ADD CONSTRAINT players_tg_id_key UNIQUE (tg_id);
+DROP INDEX idx_players_course_login;
+ALTER TABLE players ADD CONSTRAINT players_login_key UNIQUE (login);
+
+ALTER TABLE export_jobs DROP COLUMN course_id;
+ALTER TABLE sessions DROP COLUMN course_id;
+ALTER TABLE roster_users DROP COLUMN course_id;
+ALTER TABLE players DROP COLUMN course_id;
+DROP TABLE courses;
@@ -0,0 +1,37 @@
+CREATE TABLE courses (
+    id         bigserial PRIMARY KEY,
+    created_at timestamptz NOT NULL DEFAULT now(),
+    slug       text        NOT NULL UNIQUE,
+    name       text        NOT NULL,
+    directory  text        NOT NULL DEFAULT ''
+);
+
+-- everything that exists so far belongs to the default course
+INSERT INTO courses (id, slug, name) VALUES (1, 'default', 'Default course');
+SELECT setval('courses_id_seq', 1);
+
+ALTER TABLE players ADD COLUMN course_id bigint NOT NULL DEFAULT 1 REFERENCES courses;
+ALTER TABLE roster_users ADD COLUMN course_id bigint NOT NULL DEFAULT 1 REFERENCES courses;
+ALTER TABLE sessions ADD COLUMN course_id bigint NOT NULL DEFAULT 1 REFERENCES courses;
+ALTER TABLE export_jobs ADD COLUMN course_id bigint NOT NULL DEFAULT 1 REFERENCES courses;
+ALTER TABLE players ALTER COLUMN course_id DROP DEFAULT;
+ALTER TABLE roster_users ALTER COLUMN course_id DROP DEFAULT;
+ALTER TABLE sessions ALTER COLUMN course_id DROP DEFAULT;
+ALTER TABLE export_jobs ALTER COLUMN course_id DROP DEFAULT;
+
+-- logins and Telegram accounts are unique per course now. The login constraint is named
+-- differently in databases that AutoMigrate created
+ALTER TABLE players DROP CONSTRAINT IF EXISTS players_login_key;
+ALTER TABLE players DROP CONSTRAINT IF EXISTS uni_players_login;
+DROP INDEX IF EXISTS idx_players_login;
+CREATE UNIQUE INDEX idx_players_course_login ON players (course_id, login);
+ALTER TABLE players DROP CONSTRAINT players_tg_id_key;
+CREATE UNIQUE INDEX idx_players_course_tg_id ON players (course_id, tg_id);
+ALTER TABLE roster_users DROP CONSTRAINT roster_users_tg_id_key;
+CREATE UNIQUE INDEX idx_roster_users_course_tg_id ON roster_users (course_id, tg_id);
+CREATE INDEX idx_sessions_course_login ON sessions (course_id, login);
+
+-- empty for the default course, so entries from before keep their hash
+-- (kept by the down migration, hence IF NOT EXISTS)
+ALTER TABLE audit_entries ADD COLUMN IF NOT EXISTS course text NOT NULL DEFAULT '';
+CREATE INDEX IF NOT EXISTS idx_audit_entries_course ON audit_entries (course);
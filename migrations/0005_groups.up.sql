@@ -0,0 +1,20 @@
+-- lab groups of a course, managed by its instructors
+CREATE TABLE groups (
+    id         bigserial PRIMARY KEY,
+    course_id  bigint      NOT NULL REFERENCES courses,
+    created_at timestamptz NOT NULL DEFAULT now(),
+    slug       text        NOT NULL,
+    name       text        NOT NULL
+);
+CREATE UNIQUE INDEX idx_groups_course_slug ON groups (course_id, slug);
+
+-- members are logins, so students can be grouped before they register.
+-- A student is in at most one group of a course
+CREATE TABLE group_members (
+    group_id   bigint      NOT NULL REFERENCES groups ON DELETE CASCADE,
+    course_id  bigint      NOT NULL REFERENCES courses,
+    login      text        NOT NULL,
+    created_at timestamptz NOT NULL DEFAULT now(),
+    PRIMARY KEY (group_id, login)
+);
+CREATE UNIQUE INDEX idx_group_members_course_login ON group_members (course_id, login);
@@ -0,0 +1,3 @@
+DROP TABLE assignments;
+ALTER TABLE score_records DROP COLUMN seed;
+ALTER TABLE score_records DROP COLUMN difficulty;
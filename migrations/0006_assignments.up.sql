@@ -0,0 +1,16 @@
+-- what a score was played on, so assignments can tell "800 on 6x6" from "800 on 4x4"
+ALTER TABLE score_records ADD COLUMN difficulty text NOT NULL DEFAULT '';
+ALTER TABLE score_records ADD COLUMN seed text NOT NULL DEFAULT '';
+
+CREATE TABLE assignments (
+    id           bigserial PRIMARY KEY,
+    course_id    bigint      NOT NULL REFERENCES courses,
+    created_at   timestamptz NOT NULL DEFAULT now(),
+    title        text        NOT NULL,
+    difficulty   text        NOT NULL DEFAULT '',
+    seed         text        NOT NULL DEFAULT '',
+    target_score bigint      NOT NULL,
+    opens_at     timestamptz NOT NULL,
+    due_at       timestamptz NOT NULL
+);
+CREATE INDEX idx_assignments_course_due ON assignments (course_id, due_at);
@@ -0,0 +1 @@
+-- the backfilled records cannot be told from played ones and stay
@@ -0,0 +1,7 @@
+-- best scores reached before score history existed only live in players.score, the grade sheet
+-- reads score_records. Such a score was reached before the first recorded one, or before the
+-- last change of the player when nothing was recorded
+INSERT INTO score_records (created_at, player_id, score)
+SELECT COALESCE((SELECT MIN(r.created_at) FROM score_records r WHERE r.player_id = p.id), p.updated_at, p.created_at), p.id, p.score
+FROM players p
+WHERE p.score > COALESCE((SELECT MAX(r.score) FROM score_records r WHERE r.player_id = p.id), 0);
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultPageLimit = 50
+	maxPageLimit     = 500
+)
+
+// Page is a keyset pagination window: up to Limit rows strictly after the cursor in the requested order
+type Page struct {
+	Limit int
+	Sort  string // database column
+	Desc  bool
+	After *Cursor
+}
+
+// Cursor points at the last row of the previous page. It is tied to the order it was created for
+type Cursor struct {
+	Sort  string          `json:"s"`
+	Desc  bool            `json:"d,omitempty"`
+	Value json.RawMessage `json:"v"`
+	ID    uint            `json:"id"`
+}
+
+// parsePage reads limit, sort and after from the query string.
+// sorts maps public sort names to columns, "-name" sorts descending
+func parsePage(c *gin.Context, sorts map[string]string, defaultSort string) (Page, error) {
+	page := Page{Limit: defaultPageLimit}
+
+	if limit := c.Query("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 || n > maxPageLimit {
+			return Page{}, invalidParam("limit", "range", map[string]string{"min": "1", "max": strconv.Itoa(maxPageLimit)})
+		}
+		page.Limit = n
+	}
+
+	sort := c.DefaultQuery("sort", defaultSort)
+	sort, page.Desc = strings.CutPrefix(sort, "-")
+	column, ok := sorts[sort]
+	if !ok {
+		names := make([]string, 0, len(sorts))
+		for name := range sorts {
+			names = append(names, name)
+		}
+		return Page{}, invalidParam("sort", "oneof", map[string]string{"values": strings.Join(names, ", ")})
+	}
+	page.Sort = column
+
+	if after := c.Query("after"); after != "" {
+		cursor, err := decodeCursor(after)
+		if err != nil || cursor.Sort != page.Sort || cursor.Desc != page.Desc {
+			return Page{}, invalidParam("after", "cursor", nil)
+		}
+		page.After = cursor
+	}
+
+	return page, nil
+}
+
+// decodeCursor reads a cursor made by next
+func decodeCursor(value string) (*Cursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+
+	var cursor Cursor
+	if err := json.Unmarshal(raw, &cursor); err != nil {
+		return nil, err
+	}
+	return &cursor, nil
+}
+
+// apply narrows the query to the page. after is the cursor value decoded into the column's Go type
+func (p Page) apply(query *gorm.DB, after interface{}) *gorm.DB {
+	op, direction := ">", "ASC"
+	if p.Desc {
+		op, direction = "<", "DESC"
+	}
+
+	if p.After != nil {
+		query = query.Where(fmt.Sprintf("(%s, id) %s (?, ?)", p.Sort, op), after, p.After.ID)
+	}
+
+	// one extra row tells whether there is a next page
+	return query.Order(p.Sort + " " + direction).Order("id " + direction).Limit(p.Limit + 1)
+}
+
+// next builds the cursor pointing at the given row
+func (p Page) next(value interface{}, id uint) (string, error) {
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+
+	encoded, err := json.Marshal(Cursor{Sort: p.Sort, Desc: p.Desc, Value: raw, ID: id})
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(encoded), nil
+}
+
+// setPageHeaders sends the total count and a Link to the next page when there is one
+func setPageHeaders(c *gin.Context, total int64, next string) {
+	c.Header("X-Total-Count", strconv.FormatInt(total, 10))
+
+	if next == "" {
+		return
+	}
+
+	nextURL := url.URL{Path: c.Request.URL.Path}
+	query := c.Request.URL.Query()
+	query.Set("after", next)
+	nextURL.RawQuery = query.Encode()
+
+	c.Writer.Header().Add("Link", fmt.Sprintf(`<%s>; rel="next"`, nextURL.String()))
+}
+
+// decodeCursorValue reads the value of a cursor as the Go type of its column. The cursor comes from
+// the client, so a value of the wrong type is a bad after parameter
+func decodeCursorValue[T any](raw json.RawMessage) (T, error) {
+	var value T
+	if err := json.Unmarshal(raw, &value); err != nil {
+		return value, invalidParam("after", "cursor", nil)
+	}
+	return value, nil
+}
+
+// escapeLike makes user input match literally inside a LIKE pattern
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
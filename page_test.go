@@ -0,0 +1,33 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestDecodeCursorValue(t *testing.T) {
+	score, err := decodeCursorValue[uint](json.RawMessage(`900`))
+	if err != nil || score != 900 {
+		t.Fatalf("decodeCursorValue(900) = %v, %v", score, err)
+	}
+
+	for name, decode := range map[string]func() error{
+		"string as score":   func() error { _, err := decodeCursorValue[uint](json.RawMessage(`"abc"`)); return err },
+		"negative score":    func() error { _, err := decodeCursorValue[uint](json.RawMessage(`-1`)); return err },
+		"number as login":   func() error { _, err := decodeCursorValue[string](json.RawMessage(`42`)); return err },
+		"text as timestamp": func() error { _, err := decodeCursorValue[time.Time](json.RawMessage(`"yesterday"`)); return err },
+	} {
+		err := decode()
+		if err == nil {
+			t.Errorf("%s: decoded", name)
+			continue
+		}
+		problem := problemFor(context.Background(), err, "en")
+		if problem.Status != http.StatusBadRequest || len(problem.Errors) != 1 || problem.Errors[0].Field != "after" {
+			t.Errorf("%s: became %d %s %+v, want 400 on after", name, problem.Status, problem.Code, problem.Errors)
+		}
+	}
+}
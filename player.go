@@ -1,23 +1,90 @@
 package main
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"gorm.io/gorm"
-	"log"
+	"time"
 )
 
-func GetAllPlayers() []Player {
+type PlayerFilter struct {
+	MinScore    uint
+	LoginPrefix string
+	// Group is the slug of a group, its members make up the leaderboard
+	Group string
+}
+
+var playerSorts = map[string]string{"score": "score", "login": "login", "created": "created_at"}
+
+// FindPlayers returns one page of players matching the filter, the number of all matches and the cursor of the next page
+func FindPlayers(ctx context.Context, filter PlayerFilter, page Page) ([]Player, int64, string, error) {
+	query := GameDB.WithContext(ctx).Model(&Player{}).Scopes(inCourse)
+	if filter.MinScore > 0 {
+		query = query.Where("score >= ?", filter.MinScore)
+	}
+	if filter.LoginPrefix != "" {
+		query = query.Where("login LIKE ?", escapeLike(filter.LoginPrefix)+"%")
+	}
+	if filter.Group != "" {
+		group, err := GetGroup(ctx, filter.Group)
+		if err != nil {
+			return nil, 0, "", err
+		}
+		query = query.Where("login IN (?)", GameDB.Model(&GroupMember{}).Select("login").Where("group_id = ?", group.ID))
+	}
+	query = query.Session(&gorm.Session{})
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		return nil, 0, "", err
+	}
+
+	var after interface{}
+	if page.After != nil {
+		var err error
+		switch page.Sort {
+		case "score":
+			after, err = decodeCursorValue[uint](page.After.Value)
+		case "created_at":
+			after, err = decodeCursorValue[time.Time](page.After.Value)
+		default:
+			after, err = decodeCursorValue[string](page.After.Value)
+		}
+		if err != nil {
+			return nil, 0, "", err
+		}
+	}
+
 	var players []Player
-	result := BotDB.Table("players").Find(&players)
-	if result.Error != nil {
-		log.Fatal(result.Error)
+	if err := page.apply(query, after).Find(&players).Error; err != nil {
+		return nil, 0, "", err
 	}
-	return players
+
+	if len(players) <= page.Limit {
+		return players, total, "", nil
+	}
+
+	players = players[:page.Limit]
+	last := players[len(players)-1]
+
+	var value interface{}
+	switch page.Sort {
+	case "score":
+		value = last.Score
+	case "created_at":
+		value = last.CreatedAt
+	default:
+		value = last.Login
+	}
+
+	next, err := page.next(value, last.ID)
+	return players, total, next, err
 }
 
-func GetPlayerByLogin(login string) (Player, error) {
+func GetPlayerByLogin(ctx context.Context, login string) (Player, error) {
 	var player Player
-	result := BotDB.Where("login = ?", login).First(&player)
+	result := GameDB.WithContext(ctx).Scopes(inCourse).Where("login = ?", login).First(&player)
 	if result.Error != nil {
 		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
 			return player, &NoSuchPlayerError{login}
@@ -27,8 +94,8 @@ func GetPlayerByLogin(login string) (Player, error) {
 	return player, nil
 }
 
-func CreatePlayer(login, password string) (Player, error) {
-	existingPlayer, err := GetPlayerByLogin(login)
+func CreatePlayer(ctx context.Context, login, password string) (Player, error) {
+	existingPlayer, err := GetPlayerByLogin(ctx, login)
 	if err == nil {
 		return existingPlayer, &PlayerExistsError{Login: login}
 	}
@@ -37,21 +104,33 @@ func CreatePlayer(login, password string) (Player, error) {
 		return Player{}, err
 	}
 
-	_, err = GetUserByUsername(login)
+	user, err := Users.GetUser(ctx, login)
 
 	if err != nil {
-		if !errors.Is(err, gorm.ErrRecordNotFound) {
+		if !errors.Is(err, ErrUserNotFound) {
 			return Player{}, err
 		}
 		return Player{}, &NoSuchUserError{Login: login}
 	}
 
 	newPlayer := Player{
+		CourseID: courseFrom(ctx).ID,
 		Login:    login,
 		Password: password,
 	}
+	if user.TgId != 0 {
+		// a renamed student the roster sync has not caught up with yet still has their old player
+		linked, err := linkedPlayer(GameDB.WithContext(ctx), user.TgId)
+		if err != nil {
+			return Player{}, err
+		}
+		if linked != nil {
+			return *linked, &PlayerExistsError{Login: linked.Login}
+		}
+		newPlayer.TgId = &user.TgId
+	}
 
-	result := BotDB.Create(&newPlayer)
+	result := GameDB.WithContext(ctx).Create(&newPlayer)
 	if result.Error != nil {
 		return Player{}, result.Error
 	}
@@ -59,29 +138,157 @@ func CreatePlayer(login, password string) (Player, error) {
 	return newPlayer, nil
 }
 
-// SetPlayerScore returns current player's score
-func SetPlayerScore(login string, newScore uint) (uint, error) {
+// SetPlayerScore records a score played on difficulty and seed, both optional,
+// and returns player's score before and after the update
+func SetPlayerScore(ctx context.Context, login string, newScore uint, difficulty, seed string) (uint, uint, error) {
 
 	var player Player
 
-	result := BotDB.Where("login = ?", login).First(&player)
+	result := GameDB.WithContext(ctx).Scopes(inCourse).Where("login = ?", login).First(&player)
 	if result.Error != nil {
 		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
-			return 0, &NoSuchPlayerError{login}
+			return 0, 0, &NoSuchPlayerError{login}
+		}
+		return 0, 0, result.Error
+	}
+
+	oldScore, score := player.Score, player.Score
+
+	err := GameDB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&ScoreRecord{PlayerID: player.ID, Score: newScore, Difficulty: difficulty, Seed: seed}).Error; err != nil {
+			return err
+		}
+
+		if newScore <= oldScore {
+			return nil
+		}
+		// only the score column, and only upwards: a password reset or rename since the read stays,
+		// and a concurrent higher submission is not replaced by this one
+		result := tx.Model(&Player{}).Where("id = ? AND score < ?", player.ID, newScore).Update("score", newScore)
+		if result.Error != nil {
+			return result.Error
 		}
-		return 0, result.Error
+		if result.RowsAffected > 0 {
+			score = newScore
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return oldScore, score, nil
+}
+
+// GetScoreHistory returns every score the player ever submitted, oldest first
+func GetScoreHistory(ctx context.Context, playerID uint) ([]ScoreRecord, error) {
+	var records []ScoreRecord
+	result := GameDB.WithContext(ctx).Where("player_id = ?", playerID).Order("created_at").Find(&records)
+	return records, result.Error
+}
+
+// SetPlayerLanguage stores the language the player wants messages in, empty means Accept-Language decides
+func SetPlayerLanguage(ctx context.Context, login, lang string) error {
+	result := GameDB.WithContext(ctx).Model(&Player{}).Scopes(inCourse).Where("login = ?", login).Update("language", lang)
+	if result.Error != nil {
+		return result.Error
 	}
+	if result.RowsAffected == 0 {
+		return &NoSuchPlayerError{login}
+	}
+	return nil
+}
 
-	needsUpdate := newScore > player.Score
+// ChangePlayerPassword replaces the password after checking the old one and logs the player out everywhere
+func ChangePlayerPassword(ctx context.Context, login, oldPassword, newPassword string) error {
+	player, err := GetPlayerByLogin(ctx, login)
+	if err != nil {
+		return err
+	}
 
-	if needsUpdate {
-		player.Score = newScore
+	if player.Password != oldPassword {
+		return &WrongPasswordError{Login: login}
+	}
 
-		result = BotDB.Save(&player)
+	return ResetPlayerPassword(ctx, login, newPassword)
+}
+
+// ResetPlayerPassword sets a new password without knowing the old one and logs the player out everywhere
+func ResetPlayerPassword(ctx context.Context, login, newPassword string) error {
+	return GameDB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&Player{}).Scopes(inCourse).Where("login = ?", login).Update("password", newPassword)
 		if result.Error != nil {
-			return 0, result.Error
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return &NoSuchPlayerError{login}
 		}
+
+		return revokeSessions(tx, login)
+	})
+}
+
+// AnonymizePlayer keeps the score on the leaderboard but removes everything that ties it to the person.
+// The login becomes free for registration again
+func AnonymizePlayer(ctx context.Context, login string) error {
+	player, err := GetPlayerByLogin(ctx, login)
+	if err != nil {
+		return err
+	}
+
+	err = GameDB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&player).Updates(map[string]interface{}{
+			"login":    fmt.Sprintf("deleted-%d", player.ID),
+			"password": "",
+			"is_admin": false,
+			"tg_id":    nil,
+		}).Error
+		if err != nil {
+			return err
+		}
+
+		if err := tx.Scopes(inCourse).Where("login = ?", login).Delete(&ExportJob{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Scopes(inCourse).Where("login = ?", login).Delete(&GroupMember{}).Error; err != nil {
+			return err
+		}
+		return tx.Scopes(inCourse).Where("login = ?", login).Delete(&Session{}).Error
+	})
+	if err != nil {
+		return err
+	}
+
+	return ResetLoginAttempts(loginKey(ctx, login))
+}
+
+// DeletePlayer removes the player and their history for good.
+// Audit entries stay: they are hash-chained and removing one would break the chain
+func DeletePlayer(ctx context.Context, login string) error {
+	player, err := GetPlayerByLogin(ctx, login)
+	if err != nil {
+		return err
+	}
+
+	err = GameDB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("player_id = ?", player.ID).Delete(&ScoreRecord{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Scopes(inCourse).Where("login = ?", login).Delete(&ExportJob{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Scopes(inCourse).Where("login = ?", login).Delete(&Session{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Scopes(inCourse).Where("login = ?", login).Delete(&GroupMember{}).Error; err != nil {
+			return err
+		}
+
+		return tx.Unscoped().Delete(&player).Error
+	})
+	if err != nil {
+		return err
 	}
 
-	return player.Score, nil
+	return ResetLoginAttempts(loginKey(ctx, login))
 }
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"log/slog"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"slices"
+	"sync"
+	"time"
+)
+
+// set at build time with -ldflags "-X main.buildCommit=... -X main.buildTime=..."
+var (
+	buildCommit = ""
+	buildTime   = ""
+)
+
+// readyTimeout bounds the database ping of a readiness check
+const readyTimeout = 2 * time.Second
+
+// workerRegistry knows which background workers are running, so readiness can tell when one died
+// and shutdown can stop them in order
+type workerRegistry struct {
+	mu      sync.Mutex
+	running map[string]bool
+	order   []*worker
+}
+
+type worker struct {
+	name   string
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+var Workers = &workerRegistry{running: map[string]bool{}}
+
+// Run starts fn in its own goroutine and keeps it registered until it returns.
+// fn should return soon after ctx is cancelled
+func (w *workerRegistry) Run(name string, fn func(ctx context.Context)) {
+	ctx, cancel := context.WithCancel(context.Background())
+	entry := &worker{name: name, cancel: cancel, done: make(chan struct{})}
+
+	w.mu.Lock()
+	w.running[name] = true
+	w.order = append(w.order, entry)
+	w.mu.Unlock()
+
+	go func() {
+		defer close(entry.done)
+		defer w.set(name, false)
+		fn(ctx)
+	}()
+}
+
+// Stop cancels the workers newest first, waiting for each before stopping the next,
+// so a worker never outlives one it feeds. It gives up when ctx expires
+func (w *workerRegistry) Stop(ctx context.Context) error {
+	w.mu.Lock()
+	order := slices.Clone(w.order)
+	w.order = nil
+	w.mu.Unlock()
+
+	for i := len(order) - 1; i >= 0; i-- {
+		entry := order[i]
+		entry.cancel()
+
+		select {
+		case <-entry.done:
+			slog.Info("worker stopped", slog.String("worker", entry.name))
+		case <-ctx.Done():
+			return fmt.Errorf("worker %s did not stop in time: %w", entry.name, ctx.Err())
+		}
+	}
+	return nil
+}
+
+func (w *workerRegistry) set(name string, running bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.running[name] = running
+}
+
+func (w *workerRegistry) snapshot() map[string]bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	running := make(map[string]bool, len(w.running))
+	for name, ok := range w.running {
+		running[name] = ok
+	}
+	return running
+}
+
+type Check struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type Readiness struct {
+	Status string           `json:"status"`
+	Checks map[string]Check `json:"checks"`
+}
+
+type BuildInfo struct {
+	Commit    string `json:"commit"`
+	BuildTime string `json:"build_time"`
+	GoVersion string `json:"go_version"`
+}
+
+// currentBuildInfo falls back to the VCS stamp Go embeds when the ldflags were not given
+func currentBuildInfo() BuildInfo {
+	info := BuildInfo{Commit: buildCommit, BuildTime: buildTime, GoVersion: runtime.Version()}
+
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range bi.Settings {
+			switch {
+			case setting.Key == "vcs.revision" && info.Commit == "":
+				info.Commit = setting.Value
+			case setting.Key == "vcs.time" && info.BuildTime == "":
+				info.BuildTime = setting.Value
+			}
+		}
+	}
+
+	if info.Commit == "" {
+		info.Commit = "unknown"
+	}
+	if info.BuildTime == "" {
+		info.BuildTime = "unknown"
+	}
+	return info
+}
+
+// Healthz godoc
+// @Summary Liveness probe
+// @Tags health
+// @x-v1 true
+// @x-v2 true
+// @Description Answers as long as the process serves requests. It never touches the database.
+// @Produce json
+// @Success 200 {object} Check
+// @Router /healthz [get]
+func Healthz(c *gin.Context) {
+	c.IndentedJSON(http.StatusOK, Check{Status: "ok"})
+}
+
+// Readyz godoc
+// @Summary Readiness probe
+// @Tags health
+// @x-v1 true
+// @x-v2 true
+// @Description Pings the game and users databases and checks that the background workers are running. An unreachable users database only marks its check degraded.
+// @Produce json
+// @Success 200 {object} Readiness
+// @Failure 503 {object} Readiness "Not ready to take traffic"
+// @Router /readyz [get]
+func Readyz(c *gin.Context) {
+	readiness := Readiness{Status: "ready", Checks: map[string]Check{}}
+
+	if shuttingDown.Load() {
+		readiness.Checks["server"] = Check{Status: "down", Error: "shutting down"}
+	}
+
+	err := pingDB(GameDB, readyTimeout)
+	DBHealth.report(err)
+	if err != nil {
+		// the probe is public, the driver error stays in the log
+		slog.Warn("readiness check failed", slog.String("check", "database"), slog.Any("error", err))
+		readiness.Checks["database"] = Check{Status: "down", Error: "unreachable"}
+	} else {
+		readiness.Checks["database"] = Check{Status: "ok"}
+	}
+
+	// without the users database only registration and user lookups suffer, and cached users still
+	// answer those, so taking the instance out of rotation would not help
+	if err := pingDB(UsersDB, readyTimeout); err != nil {
+		slog.Warn("readiness check failed", slog.String("check", "users_database"), slog.Any("error", err))
+		readiness.Checks["users_database"] = Check{Status: "degraded", Error: "unreachable"}
+	} else {
+		readiness.Checks["users_database"] = Check{Status: "ok"}
+	}
+
+	for name, running := range Workers.snapshot() {
+		if running {
+			readiness.Checks[name] = Check{Status: "ok"}
+		} else {
+			readiness.Checks[name] = Check{Status: "down", Error: "worker has stopped"}
+		}
+	}
+
+	status := http.StatusOK
+	for _, check := range readiness.Checks {
+		if check.Status == "down" {
+			readiness.Status = "unavailable"
+			status = http.StatusServiceUnavailable
+			break
+		}
+	}
+
+	c.Header("Cache-Control", "no-store")
+	c.IndentedJSON(status, readiness)
+}
+
+// Version godoc
+// @Summary Build information
+// @Tags health
+// @x-v1 true
+// @x-v2 true
+// @Produce json
+// @Success 200 {object} BuildInfo
+// @Router /version [get]
+func Version(c *gin.Context) {
+	c.IndentedJSON(http.StatusOK, currentBuildInfo())
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/go-playground/validator/v10"
+	"log/slog"
+	"net/http"
+	"reflect"
+	"strings"
+)
+
+const problemContentType = "application/problem+json"
+
+// Problem is an RFC 7807 error response. Clients should branch on Code, never on Detail
+type Problem struct {
+	Type      string       `json:"type"`
+	Title     string       `json:"title"`
+	Status    int          `json:"status"`
+	Detail    string       `json:"detail,omitempty"`
+	Instance  string       `json:"instance,omitempty"`
+	Code      string       `json:"code"`
+	Errors    []FieldError `json:"errors,omitempty"`
+	TraceID   string       `json:"trace_id,omitempty"`
+	RequestID string       `json:"request_id,omitempty"` // quote it when reporting a problem
+}
+
+// problemFor turns any error into the problem the client gets to see, worded in lang.
+// Unknown errors are logged and hidden behind a generic 500
+func problemFor(ctx context.Context, err error, lang string) Problem {
+	var coded CodedError
+	if !errors.As(err, &coded) {
+		if isUnavailable(err) {
+			coded = ErrDBUnavailable
+		} else {
+			logger(ctx).Error("unhandled error", slog.Any("error", err))
+			coded = ErrInternal
+		}
+	}
+
+	problem := Problem{
+		Type:   "/problems/" + coded.Code(),
+		Title:  http.StatusText(coded.Status()),
+		Status: coded.Status(),
+		Detail: translate(lang, coded.Code(), coded.Params()),
+		Code:   coded.Code(),
+	}
+
+	var validation *ValidationError
+	if errors.As(coded, &validation) {
+		problem.Errors = validation.localized(lang)
+		if len(problem.Errors) == 1 {
+			problem.Detail = problem.Errors[0].Message
+		}
+	}
+
+	return problem
+}
+
+// respondError is the single place errors become responses. It aborts the chain, so middlewares can use it too
+func respondError(c *gin.Context, err error) {
+	problem := problemFor(c.Request.Context(), err, requestLanguage(c))
+	problem.Instance = c.Request.URL.Path
+	problem.TraceID = traceID(c.Request.Context())
+	problem.RequestID = requestID(c)
+
+	if problem.Status == http.StatusServiceUnavailable && c.Writer.Header().Get("Retry-After") == "" {
+		setRetryAfter(c, dbProbeInterval)
+	}
+
+	c.Header("Content-Type", problemContentType)
+	c.IndentedJSON(problem.Status, problem)
+	c.Abort()
+}
+
+// bindingError describes why gin could not bind the request body, field by field when possible
+func bindingError(err error) error {
+	var validationErrs validator.ValidationErrors
+	if errors.As(err, &validationErrs) {
+		fields := make([]FieldError, 0, len(validationErrs))
+		for _, fe := range validationErrs {
+			var params map[string]string
+			switch fe.Tag() {
+			case "oneof":
+				params = map[string]string{"values": strings.ReplaceAll(fe.Param(), " ", ", ")}
+			case "max":
+				params = map[string]string{"max": fe.Param()}
+			}
+			fields = append(fields, newFieldError(defaultLanguage, fe.Field(), fe.Tag(), params))
+		}
+		return &ValidationError{Fields: fields}
+	}
+
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) {
+		return invalidParam(typeErr.Field, "type", map[string]string{"type": typeErr.Type.String()})
+	}
+
+	return invalidParam("body", "json", nil)
+}
+
+// registerJSONFieldNames makes validation errors name fields the way clients send them
+func registerJSONFieldNames() {
+	v, ok := binding.Validator.Engine().(*validator.Validate)
+	if !ok {
+		return
+	}
+
+	v.RegisterTagNameFunc(func(field reflect.StructField) string {
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "" || name == "-" {
+			return field.Name
+		}
+		return name
+	})
+}
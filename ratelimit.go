@@ -0,0 +1,198 @@
+package main
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"log/slog"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RateLimit is a token bucket: Capacity requests in a burst, refilled evenly over Period
+type RateLimit struct {
+	Capacity int
+	Period   time.Duration
+}
+
+// RateBucket is the persisted state of one bucket
+type RateBucket struct {
+	Key       string    `gorm:"primarykey"`
+	Tokens    float64   `gorm:"not null"`
+	UpdatedAt time.Time `gorm:"not null;autoUpdateTime:false"`
+}
+
+type BucketStore interface {
+	// Take refills the bucket, removes one token if there is any and returns the bucket after that
+	Take(key string, limit RateLimit, now time.Time) (RateBucket, bool, error)
+}
+
+var RateLimitStore BucketStore = NewMemoryBucketStore()
+
+// ParseRateLimit reads limits written as "<requests>/<period>", e.g. "10/1m" or "300/1h"
+func ParseRateLimit(s string) (RateLimit, error) {
+	capacity, period, found := strings.Cut(s, "/")
+	if !found {
+		return RateLimit{}, fmt.Errorf("rate limit %q must look like 10/1m", s)
+	}
+
+	n, err := strconv.Atoi(capacity)
+	if err != nil || n < 1 {
+		return RateLimit{}, fmt.Errorf("rate limit %q must allow at least one request", s)
+	}
+
+	d, err := time.ParseDuration(period)
+	if err != nil || d <= 0 {
+		return RateLimit{}, fmt.Errorf("rate limit %q has an invalid period", s)
+	}
+
+	return RateLimit{Capacity: n, Period: d}, nil
+}
+
+// refill adds the tokens earned since the last update
+func (l RateLimit) refill(bucket RateBucket, now time.Time) RateBucket {
+	if bucket.UpdatedAt.IsZero() {
+		bucket.Tokens = float64(l.Capacity)
+	} else if elapsed := now.Sub(bucket.UpdatedAt); elapsed > 0 {
+		bucket.Tokens = math.Min(float64(l.Capacity), bucket.Tokens+elapsed.Seconds()*l.perSecond())
+	}
+	bucket.UpdatedAt = now
+	return bucket
+}
+
+func (l RateLimit) take(bucket RateBucket, now time.Time) (RateBucket, bool) {
+	bucket = l.refill(bucket, now)
+	if bucket.Tokens < 1 {
+		return bucket, false
+	}
+	bucket.Tokens--
+	return bucket, true
+}
+
+func (l RateLimit) perSecond() float64 {
+	return float64(l.Capacity) / l.Period.Seconds()
+}
+
+// untilTokens returns how long the bucket needs to hold n tokens again
+func (l RateLimit) untilTokens(bucket RateBucket, n float64) time.Duration {
+	missing := n - bucket.Tokens
+	if missing <= 0 {
+		return 0
+	}
+	return time.Duration(missing / l.perSecond() * float64(time.Second))
+}
+
+// RateKeyByIP buckets requests by client address
+func RateKeyByIP(c *gin.Context) string {
+	return "ip:" + c.ClientIP()
+}
+
+// RateKeyByLogin buckets requests by the JWT login and falls back to the client address for anonymous requests
+func RateKeyByLogin(c *gin.Context) string {
+	if tokenString, err := requestToken(c); err == nil {
+		if claims, err := VerifyToken(tokenString); err == nil {
+			if claims.Course != "" {
+				return "login:" + claims.Course + "/" + claims.Login
+			}
+			return "login:" + claims.Login
+		}
+	}
+	return RateKeyByIP(c)
+}
+
+// RateLimited rejects requests over the limit of the named route group and sends RateLimit-* headers
+func RateLimited(group string, limit RateLimit, keyFunc func(*gin.Context) string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		bucket, allowed, err := RateLimitStore.Take(group+"|"+keyFunc(c), limit, time.Now())
+		if err != nil {
+			// a broken limiter store must not take the API down with it
+			logger(c.Request.Context()).Error("rate limiter store failed, letting request through", slog.Any("error", err))
+			c.Next()
+			return
+		}
+
+		remaining := int(math.Floor(bucket.Tokens))
+		reset := limit.untilTokens(bucket, float64(limit.Capacity))
+
+		c.Header("RateLimit-Limit", strconv.Itoa(limit.Capacity))
+		c.Header("RateLimit-Remaining", strconv.Itoa(remaining))
+		c.Header("RateLimit-Reset", strconv.Itoa(int(math.Ceil(reset.Seconds()))))
+		c.Header("RateLimit-Policy", fmt.Sprintf("%d;w=%d", limit.Capacity, int(limit.Period.Seconds())))
+
+		if !allowed {
+			setRetryAfter(c, limit.untilTokens(bucket, 1))
+			respondError(c, ErrRateLimited)
+			return
+		}
+
+		c.Next()
+	}
+}
+
+type MemoryBucketStore struct {
+	mu      sync.Mutex
+	buckets map[string]RateBucket
+}
+
+func NewMemoryBucketStore() *MemoryBucketStore {
+	return &MemoryBucketStore{buckets: make(map[string]RateBucket)}
+}
+
+func (s *MemoryBucketStore) Take(key string, limit RateLimit, now time.Time) (RateBucket, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// a bucket untouched for a whole period is full again and can be forgotten.
+	// Only buckets of the same group share the period
+	if len(s.buckets) >= memoryStorePruneSize {
+		group, _, _ := strings.Cut(key, "|")
+		for k, b := range s.buckets {
+			if strings.HasPrefix(k, group+"|") && now.Sub(b.UpdatedAt) > limit.Period {
+				delete(s.buckets, k)
+			}
+		}
+	}
+
+	bucket := s.buckets[key]
+	bucket.Key = key
+	bucket, allowed := limit.take(bucket, now)
+	s.buckets[key] = bucket
+
+	return bucket, allowed, nil
+}
+
+// DBBucketStore shares buckets between all API instances
+type DBBucketStore struct {
+	db *gorm.DB
+}
+
+func NewDBBucketStore(db *gorm.DB) *DBBucketStore {
+	return &DBBucketStore{db: db}
+}
+
+func (s *DBBucketStore) Take(key string, limit RateLimit, now time.Time) (RateBucket, bool, error) {
+	var bucket RateBucket
+	var allowed bool
+
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		// make sure the row exists so it can be locked
+		err := tx.Clauses(clause.OnConflict{DoNothing: true}).
+			Create(&RateBucket{Key: key, Tokens: float64(limit.Capacity), UpdatedAt: now}).Error
+		if err != nil {
+			return err
+		}
+
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("key = ?", key).First(&bucket).Error; err != nil {
+			return err
+		}
+
+		bucket, allowed = limit.take(bucket, now)
+		return tx.Save(&bucket).Error
+	})
+
+	return bucket, allowed, err
+}
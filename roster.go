@@ -0,0 +1,510 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gorm.io/gorm"
+	"io"
+	"log/slog"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const rosterActor = "roster_sync"
+
+// RosterUser is the local copy of a course user. Removed students stay with Active unset,
+// so they can be restored when they come back
+type RosterUser struct {
+	ID        uint      `gorm:"primarykey"`
+	CourseID  uint      `gorm:"not null"`
+	TgId      *uint     // unique within the course, unset for imported users, who are matched by username
+	Username  string    `gorm:"not null;index"`
+	Name      string    `gorm:"not null"`
+	Active    bool      `gorm:"not null;default:true"`
+	SyncedAt  time.Time `gorm:"not null"`
+	RemovedAt *time.Time
+}
+
+// key identifies the course user across syncs, by Telegram ID when there is one
+func (r RosterUser) key() string {
+	if r.TgId != nil {
+		return userKey(User{TgId: *r.TgId, Username: r.Username})
+	}
+	return userKey(User{Username: r.Username})
+}
+
+func userKey(user User) string {
+	if user.TgId != 0 {
+		return "tg:" + strconv.FormatUint(uint64(user.TgId), 10)
+	}
+	return "username:" + user.Username
+}
+
+// UserSource lists the whole course, for copying it into the roster
+type UserSource interface {
+	AllUsers(ctx context.Context) ([]User, error)
+}
+
+// maxRosterSize caps an uploaded roster, a course of thousands fits many times over
+const maxRosterSize = 1 << 20
+
+// rosterDeactivateRemoved applies users.deactivate_removed to uploads
+var rosterDeactivateRemoved bool
+
+// RosterEntry is one course user of an uploaded roster
+type RosterEntry struct {
+	Username string `json:"username"`
+	Name     string `json:"name"`
+	TgId     uint   `json:"tg_id"`
+}
+
+// importedUsers is an uploaded roster, synced like the bot's users table
+type importedUsers []User
+
+func (u importedUsers) AllUsers(context.Context) ([]User, error) {
+	return u, nil
+}
+
+// RosterChanges counts what one sync changed
+type RosterChanges struct {
+	Added    int `json:"added"`
+	Renamed  int `json:"renamed"`
+	Removed  int `json:"removed"`
+	Restored int `json:"restored"`
+}
+
+// RosterUserDirectory answers from the synced roster, so it keeps working while the bot database is down
+type RosterUserDirectory struct {
+	db *gorm.DB
+}
+
+func NewRosterUserDirectory(db *gorm.DB) *RosterUserDirectory {
+	return &RosterUserDirectory{db: db}
+}
+
+// active reads the roster like the bot's users table, imported users have a zero TgId
+func (d *RosterUserDirectory) active(ctx context.Context) *gorm.DB {
+	return d.db.WithContext(ctx).Table("(SELECT id, COALESCE(tg_id, 0) AS tg_id, username, name FROM roster_users WHERE active AND course_id = ?) AS users",
+		courseFrom(ctx).ID)
+}
+
+func (d *RosterUserDirectory) FindUsers(ctx context.Context, filter UserFilter, page Page) ([]User, int64, string, error) {
+	return findUsers(d.active(ctx), filter, page)
+}
+
+func (d *RosterUserDirectory) GetUser(ctx context.Context, username string) (User, error) {
+	return getUser(d.active(ctx), username)
+}
+
+// StartRosterSync copies the bot's users into the roster of every course using the bot directory,
+// right away and then every interval
+func StartRosterSync(source UserSource, cfg UsersConfig) {
+	Workers.Run("roster_sync", func(ctx context.Context) {
+		ticker := time.NewTicker(cfg.SyncInterval)
+		defer ticker.Stop()
+
+		for {
+			if err := syncBotCourses(ctx, source, cfg.DeactivateRemoved); err != nil && ctx.Err() == nil {
+				slog.Error("roster sync failed", slog.Any("error", err))
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	})
+}
+
+// syncBotCourses runs SyncRoster for every course whose users come from the bot
+func syncBotCourses(ctx context.Context, source UserSource, deactivateRemoved bool) error {
+	courses, err := FindCourses(ctx)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, course := range courses {
+		if course.directory() != "bot" {
+			continue
+		}
+
+		changes, err := SyncRoster(withCourse(ctx, course), source, deactivateRemoved, rosterActor)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("course %s: %w", course.Slug, err))
+		}
+		if changes != (RosterChanges{}) {
+			slog.Info("roster synced", slog.String("course", course.Slug),
+				slog.Int("added", changes.Added), slog.Int("renamed", changes.Renamed),
+				slog.Int("removed", changes.Removed), slog.Int("restored", changes.Restored))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// SyncRoster brings the roster of the course of ctx in line with source. Players follow their course user by Telegram ID:
+// a rename changes the player's login, so the scores stay with the student. With deactivateRemoved,
+// players whose user left the course can no longer log in, until the user comes back.
+// Users without a Telegram ID are matched by username, for them a rename is a removal and an addition.
+// A change that fails is reported and tried again on the next sync, the others still apply.
+// actor is who the audit log names for the changes to players
+func SyncRoster(ctx context.Context, source UserSource, deactivateRemoved bool, actor string) (RosterChanges, error) {
+	var changes RosterChanges
+
+	users, err := source.AllUsers(ctx)
+	if err != nil {
+		return changes, fmt.Errorf("listing course users: %w", err)
+	}
+
+	var roster []RosterUser
+	if err := GameDB.WithContext(ctx).Scopes(inCourse).Find(&roster).Error; err != nil {
+		return changes, err
+	}
+	byKey := make(map[string]RosterUser, len(roster))
+	for _, entry := range roster {
+		// a username can come back after it was removed, the active entry is the one to follow
+		if existing, found := byKey[entry.key()]; !found || !existing.Active {
+			byKey[entry.key()] = entry
+		}
+	}
+
+	// an entry imported without a Telegram ID keeps its history once the ID becomes known
+	var errs []error
+	for _, user := range users {
+		entry, found := byKey[userKey(User{Username: user.Username})]
+		if user.TgId == 0 || !found {
+			continue
+		}
+		if _, taken := byKey[userKey(user)]; taken {
+			continue
+		}
+		if err := GameDB.WithContext(ctx).Model(&entry).Update("tg_id", user.TgId).Error; err != nil {
+			errs = append(errs, fmt.Errorf("adding the Telegram ID of %s: %w", user.Username, err))
+			continue
+		}
+		tgId := user.TgId
+		entry.TgId = &tgId
+		delete(byKey, userKey(User{Username: user.Username}))
+		byKey[userKey(user)] = entry
+	}
+
+	// players registered before the roster existed are linked by their login, while it is still the old username
+	if err := linkPlayers(ctx); err != nil {
+		return changes, err
+	}
+
+	now := time.Now()
+	seen := make(map[string]bool, len(users))
+
+	for _, user := range users {
+		seen[userKey(user)] = true
+		entry, found := byKey[userKey(user)]
+
+		switch {
+		case !found:
+			entry := RosterUser{CourseID: courseFrom(ctx).ID, Username: user.Username, Name: user.Name, Active: true, SyncedAt: now}
+			if user.TgId != 0 {
+				entry.TgId = &user.TgId
+			}
+			err := GameDB.WithContext(ctx).Create(&entry).Error
+			if err != nil {
+				errs = append(errs, fmt.Errorf("adding %s: %w", user.Username, err))
+				continue
+			}
+			changes.Added++
+			rosterChanges.WithLabelValues("added").Inc()
+
+		case entry.Username != user.Username:
+			if err := renameRosterUser(ctx, entry, user, actor); err != nil {
+				errs = append(errs, fmt.Errorf("renaming %s to %s: %w", entry.Username, user.Username, err))
+				continue
+			}
+			changes.Renamed++
+			rosterChanges.WithLabelValues("renamed").Inc()
+
+		case entry.Name != user.Name:
+			if err := GameDB.WithContext(ctx).Model(&entry).Update("name", user.Name).Error; err != nil {
+				errs = append(errs, fmt.Errorf("updating the name of %s: %w", user.Username, err))
+				continue
+			}
+		}
+
+		if found && !entry.Active {
+			if err := restoreRosterUser(ctx, entry, actor); err != nil {
+				errs = append(errs, fmt.Errorf("restoring %s: %w", user.Username, err))
+				continue
+			}
+			changes.Restored++
+			rosterChanges.WithLabelValues("restored").Inc()
+		}
+	}
+
+	// an empty course is far more likely a broken bot database than every student leaving at once
+	if len(users) == 0 && len(roster) > 0 {
+		slog.Warn("course user source returned no users, not removing anyone from the roster")
+	} else {
+		for key, entry := range byKey {
+			if !entry.Active || seen[key] {
+				continue
+			}
+			if err := removeRosterUser(ctx, entry, deactivateRemoved, actor); err != nil {
+				errs = append(errs, fmt.Errorf("removing %s: %w", entry.Username, err))
+				continue
+			}
+			changes.Removed++
+			rosterChanges.WithLabelValues("removed").Inc()
+		}
+	}
+
+	if err := GameDB.WithContext(ctx).Model(&RosterUser{}).Scopes(inCourse).Where("active").Update("synced_at", now).Error; err != nil {
+		errs = append(errs, err)
+	}
+	if err := linkPlayers(ctx); err != nil {
+		errs = append(errs, err)
+	}
+
+	return changes, errors.Join(errs...)
+}
+
+// linkPlayers gives players without a Telegram ID the one of the active roster user with their login
+func linkPlayers(ctx context.Context) error {
+	return GameDB.WithContext(ctx).Exec(`UPDATE players SET tg_id = roster_users.tg_id
+		FROM roster_users
+		WHERE players.course_id = ? AND roster_users.course_id = players.course_id
+			AND players.tg_id IS NULL AND players.deleted_at IS NULL
+			AND roster_users.active AND roster_users.tg_id IS NOT NULL AND players.login = roster_users.username
+			AND NOT EXISTS (SELECT 1 FROM players linked WHERE linked.course_id = players.course_id AND linked.tg_id = roster_users.tg_id)`,
+		courseFrom(ctx).ID).Error
+}
+
+// linkedPlayer returns the player of a Telegram account in the course of tx, if they registered
+func linkedPlayer(tx *gorm.DB, tgId uint) (*Player, error) {
+	var players []Player
+	if err := tx.Scopes(inCourse).Where("tg_id = ?", tgId).Limit(1).Find(&players).Error; err != nil || len(players) == 0 {
+		return nil, err
+	}
+	return &players[0], nil
+}
+
+// rosterPlayer returns the player of a roster user, by login for users without a Telegram ID
+func rosterPlayer(tx *gorm.DB, entry RosterUser) (*Player, error) {
+	if entry.TgId != nil {
+		return linkedPlayer(tx, *entry.TgId)
+	}
+
+	var players []Player
+	if err := tx.Scopes(inCourse).Where("login = ? AND tg_id IS NULL", entry.Username).Limit(1).Find(&players).Error; err != nil || len(players) == 0 {
+		return nil, err
+	}
+	return &players[0], nil
+}
+
+// renameRosterUser moves the player to the new username. Their tokens carry the old login, so they are revoked
+func renameRosterUser(ctx context.Context, entry RosterUser, user User, actor string) error {
+	oldUsername := entry.Username
+	var player *Player
+	err := GameDB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&entry).Updates(map[string]interface{}{"username": user.Username, "name": user.Name}).Error
+		if err != nil {
+			return err
+		}
+
+		if player, err = rosterPlayer(tx, entry); err != nil || player == nil {
+			return err
+		}
+
+		if err := tx.Model(player).Update("login", user.Username).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&ExportJob{}).Scopes(inCourse).Where("login = ?", oldUsername).Update("login", user.Username).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&GroupMember{}).Scopes(inCourse).Where("login = ?", oldUsername).Update("login", user.Username).Error; err != nil {
+			return err
+		}
+		return revokeSessions(tx, oldUsername)
+	})
+	if err != nil || player == nil {
+		return err
+	}
+
+	rosterAudit(ctx, AuditPlayerRename, user.Username, actor, "renamed from "+oldUsername)
+	return nil
+}
+
+func removeRosterUser(ctx context.Context, entry RosterUser, deactivate bool, actor string) error {
+	var player *Player
+	err := GameDB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		if err := tx.Model(&entry).Updates(map[string]interface{}{"active": false, "removed_at": now}).Error; err != nil {
+			return err
+		}
+		if !deactivate {
+			return nil
+		}
+
+		var err error
+		if player, err = rosterPlayer(tx, entry); err != nil || player == nil || player.DeactivatedAt != nil {
+			player = nil
+			return err
+		}
+		if err := tx.Model(player).Update("deactivated_at", now).Error; err != nil {
+			return err
+		}
+		return revokeSessions(tx, player.Login)
+	})
+	if err != nil || player == nil {
+		return err
+	}
+
+	rosterAudit(ctx, AuditPlayerDeactivate, player.Login, actor, "removed from the course")
+	return nil
+}
+
+func restoreRosterUser(ctx context.Context, entry RosterUser, actor string) error {
+	var player *Player
+	err := GameDB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&entry).Updates(map[string]interface{}{"active": true, "removed_at": nil}).Error; err != nil {
+			return err
+		}
+
+		var err error
+		if player, err = rosterPlayer(tx, entry); err != nil || player == nil || player.DeactivatedAt == nil {
+			player = nil
+			return err
+		}
+		return tx.Model(player).Update("deactivated_at", nil).Error
+	})
+	if err != nil || player == nil {
+		return err
+	}
+
+	rosterAudit(ctx, AuditPlayerReactivate, player.Login, actor, "back on the course")
+	return nil
+}
+
+// revokeSessions logs the player with login out of the course of tx everywhere
+func revokeSessions(tx *gorm.DB, login string) error {
+	return tx.Model(&Session{}).Scopes(inCourse).
+		Where("login = ? AND revoked_at IS NULL", login).
+		Update("revoked_at", time.Now()).Error
+}
+
+func rosterAudit(ctx context.Context, event, login, actor, details string) {
+	err := RecordAudit(ctx, AuditEntry{Event: event, Login: login, Actor: actor, Details: details})
+	if err != nil {
+		slog.Error("failed to record audit event",
+			slog.String("event", event), slog.String("login", login), slog.Any("error", err))
+	}
+}
+
+// ImportRoster replaces the roster with an uploaded one. Students missing from it are removed,
+// renames are only recognized for entries with a tg_id
+func ImportRoster(ctx context.Context, users []User, deactivateRemoved bool, actor string) (RosterChanges, error) {
+	if courseFrom(ctx).directory() != "roster" {
+		return RosterChanges{}, ErrRosterImportDisabled
+	}
+	return SyncRoster(ctx, importedUsers(users), deactivateRemoved, actor)
+}
+
+// rosterFormat tells csv from json by the content type, then by the file extension
+func rosterFormat(contentType, filename string) string {
+	switch {
+	case strings.HasPrefix(contentType, "text/csv"):
+		return "csv"
+	case strings.HasPrefix(contentType, "application/json"):
+		return "json"
+	}
+	return strings.TrimPrefix(strings.ToLower(filepath.Ext(filename)), ".")
+}
+
+// ParseRoster reads a roster as CSV with a header row naming the username, name and optional tg_id
+// columns, or as a JSON array of RosterEntry
+func ParseRoster(r io.Reader, format string) ([]User, error) {
+	var entries []RosterEntry
+	var err error
+
+	switch format {
+	case "csv":
+		entries, err = parseRosterCSV(r)
+	case "json":
+		if json.NewDecoder(r).Decode(&entries) != nil {
+			err = invalidParam("file", "json", nil)
+		}
+	default:
+		err = invalidParam("file", "oneof", map[string]string{"values": "csv, json"})
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if len(entries) == 0 {
+		return nil, ErrRosterEmpty
+	}
+
+	users := make([]User, len(entries))
+	usernames := make(map[string]bool, len(entries))
+	tgIds := make(map[uint]bool, len(entries))
+	for i, entry := range entries {
+		username, name := strings.TrimSpace(entry.Username), strings.TrimSpace(entry.Name)
+		if username == "" || name == "" || usernames[username] || (entry.TgId != 0 && tgIds[entry.TgId]) {
+			return nil, &RosterEntryError{Entry: i + 1}
+		}
+		usernames[username] = true
+		tgIds[entry.TgId] = true
+		users[i] = User{TgId: entry.TgId, Username: username, Name: name}
+	}
+	return users, nil
+}
+
+func parseRosterCSV(r io.Reader) ([]RosterEntry, error) {
+	reader := csv.NewReader(r)
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, ErrRosterEmpty
+		}
+		return nil, invalidParam("file", "csv", nil)
+	}
+
+	columns := map[string]int{}
+	for i, name := range header {
+		// spreadsheets like to start the file with a byte order mark
+		columns[strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff")))] = i
+	}
+	usernameColumn, hasUsername := columns["username"]
+	nameColumn, hasName := columns["name"]
+	tgIdColumn, hasTgId := columns["tg_id"]
+	if !hasUsername || !hasName {
+		return nil, invalidParam("file", "csv", nil)
+	}
+
+	var entries []RosterEntry
+	for {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			return entries, nil
+		}
+		if err != nil {
+			return nil, invalidParam("file", "csv", nil)
+		}
+
+		entry := RosterEntry{Username: record[usernameColumn], Name: record[nameColumn]}
+		if hasTgId && strings.TrimSpace(record[tgIdColumn]) != "" {
+			tgId, err := strconv.ParseUint(strings.TrimSpace(record[tgIdColumn]), 10, 0)
+			if err != nil || tgId == 0 {
+				return nil, &RosterEntryError{Entry: len(entries) + 1}
+			}
+			entry.TgId = uint(tgId)
+		}
+		entries = append(entries, entry)
+	}
+}
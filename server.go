@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"gorm.io/gorm"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// shuttingDown turns readiness off as soon as shutdown starts, so no new traffic is routed here
+var shuttingDown atomic.Bool
+
+func newHTTPServer(addr string, handler http.Handler, cfg ServerConfig) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: cfg.ReadTimeout,
+		ReadTimeout:       cfg.ReadTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+	}
+}
+
+// serve runs the API, the metrics listener and the background workers until ctx is cancelled
+// (on SIGTERM or SIGINT) or a listener fails, then shuts everything down
+func serve(ctx context.Context, cfg Config, handler http.Handler) error {
+	servers := []*http.Server{newHTTPServer(fmt.Sprintf(":%d", cfg.Port), handler, cfg.Server)}
+	if metricsServer := newMetricsServer(cfg); metricsServer != nil {
+		servers = append(servers, metricsServer)
+	}
+
+	failed := make(chan error, len(servers))
+	for _, server := range servers {
+		go func(server *http.Server) {
+			slog.Info("listening", slog.String("addr", server.Addr))
+			if err := server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+				failed <- fmt.Errorf("listener on %s: %w", server.Addr, err)
+			}
+		}(server)
+	}
+
+	StartExportWorker()
+	if cfg.Users.SyncInterval > 0 {
+		StartRosterSync(NewBotUserDirectory(UsersDB), cfg.Users)
+	}
+
+	var err error
+	select {
+	case <-ctx.Done():
+		slog.Info("shutting down", slog.Duration("timeout", cfg.Server.ShutdownTimeout))
+	case err = <-failed:
+		slog.Error("listener failed, shutting down", slog.Any("error", err))
+	}
+
+	return errors.Join(err, shutdown(cfg.Server.ShutdownTimeout, servers))
+}
+
+// shutdown drains in-flight requests first, since they may still queue work, then stops the workers
+// and finally closes the connection pools they all share
+func shutdown(timeout time.Duration, servers []*http.Server) error {
+	shuttingDown.Store(true)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var errs []error
+	for _, server := range servers {
+		if err := server.Shutdown(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("draining %s: %w", server.Addr, err))
+		}
+	}
+
+	if err := Workers.Stop(ctx); err != nil {
+		errs = append(errs, err)
+	}
+
+	for _, db := range []*gorm.DB{GameDB, UsersDB} {
+		if db == nil {
+			continue
+		}
+		if sqlDB, err := db.DB(); err == nil {
+			errs = append(errs, sqlDB.Close())
+		}
+	}
+
+	err := errors.Join(errs...)
+	if err == nil {
+		slog.Info("shutdown complete")
+	}
+	return err
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func freePort(t *testing.T) int {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+func TestServeDrainsRequestsAndStopsWorkers(t *testing.T) {
+	previousGame, previousUsers := GameDB, UsersDB
+	GameDB, UsersDB = failingDB(t), nil
+	t.Cleanup(func() {
+		GameDB, UsersDB = previousGame, previousUsers
+		shuttingDown.Store(false)
+	})
+
+	started, release := make(chan struct{}), make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		io.WriteString(w, "done")
+	})
+
+	port := freePort(t)
+	cfg := Config{Port: port, Server: ServerConfig{ShutdownTimeout: 5 * time.Second}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	served := make(chan error, 1)
+	go func() { served <- serve(ctx, cfg, handler) }()
+
+	url := fmt.Sprintf("http://127.0.0.1:%d/slow", port)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+		if err == nil {
+			conn.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("server did not start listening: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	type response struct {
+		body string
+		err  error
+	}
+	responses := make(chan response, 1)
+	go func() {
+		resp, err := http.Get(url)
+		if err != nil {
+			responses <- response{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		responses <- response{string(body), err}
+	}()
+
+	<-started
+	cancel()
+
+	for !shuttingDown.Load() {
+		if time.Now().After(deadline) {
+			t.Fatal("shutdown did not start")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	select {
+	case err := <-served:
+		t.Fatalf("serve returned with a request in flight: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if running := Workers.snapshot()["export_worker"]; !running {
+		t.Error("export worker stopped before the in-flight request finished")
+	}
+
+	close(release)
+
+	if r := <-responses; r.err != nil || r.body != "done" {
+		t.Fatalf("in-flight request got %q, %v", r.body, r.err)
+	}
+
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Fatalf("serve: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("serve did not return after the request finished")
+	}
+
+	if running := Workers.snapshot()["export_worker"]; running {
+		t.Error("export worker still running after shutdown")
+	}
+	if _, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port)); err == nil {
+		t.Error("listener still accepts connections after shutdown")
+	}
+}
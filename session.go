@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+)
+
+// Session is one issued JWT. Its ID is the token's jti, so a token dies together with its session
+type Session struct {
+	ID        string `gorm:"primarykey"`
+	CourseID  uint   `gorm:"not null" json:"-"`
+	Login     string `gorm:"not null;index"`
+	IP        string
+	UserAgent string
+	CreatedAt time.Time
+	ExpiresAt time.Time `gorm:"not null"`
+	RevokedAt *time.Time
+}
+
+func CreateSession(ctx context.Context, login, ip, userAgent string, expiry time.Duration) (Session, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return Session{}, err
+	}
+
+	session := Session{
+		ID:        hex.EncodeToString(id),
+		CourseID:  courseFrom(ctx).ID,
+		Login:     login,
+		IP:        ip,
+		UserAgent: userAgent,
+		ExpiresAt: time.Now().Add(expiry),
+	}
+
+	result := GameDB.WithContext(ctx).Create(&session)
+	return session, result.Error
+}
+
+// IsSessionActive reports whether the session exists, belongs to login in the course of ctx and was not revoked
+func IsSessionActive(ctx context.Context, id, login string) (bool, error) {
+	var count int64
+	result := GameDB.WithContext(ctx).Model(&Session{}).Scopes(inCourse).
+		Where("id = ? AND login = ? AND revoked_at IS NULL AND expires_at > ?", id, login, time.Now()).
+		Count(&count)
+	return count > 0, result.Error
+}
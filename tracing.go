@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/gin-gonic/gin/otelgin"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"gorm.io/gorm"
+	"log"
+	"os"
+)
+
+const serviceName = "memoryGameAPI"
+
+var tracer = otel.Tracer(serviceName)
+
+// initTracing sets up the named exporter: stdout, otlp or none.
+// The OTLP exporter reads its endpoint and headers from the standard OTEL_EXPORTER_OTLP_* variables.
+// traceparent headers are honoured even with tracing off, so trace IDs still reach logs and error responses
+func initTracing(ctx context.Context, exporterName string) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	var exporter sdktrace.SpanExporter
+	var err error
+
+	switch exporterName {
+	case "", "none":
+		return func(context.Context) error { return nil }, nil
+	case "stdout":
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	case "otlp":
+		exporter, err = otlptracehttp.New(ctx)
+	default:
+		return nil, fmt.Errorf("unknown tracing exporter %q, use stdout, otlp or none", exporterName)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES override these
+	res, err := resource.New(ctx,
+		resource.WithAttributes(
+			attribute.String("service.name", serviceName),
+			attribute.String("service.version", currentBuildInfo().Commit),
+		),
+		resource.WithFromEnv(),
+		resource.WithTelemetrySDK(),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res))
+	otel.SetTracerProvider(provider)
+
+	return provider.Shutdown, nil
+}
+
+// Tracing starts a server span for every request, continuing the caller's trace when it sends traceparent
+func Tracing() gin.HandlerFunc {
+	return otelgin.Middleware(serviceName)
+}
+
+// traceID returns the ID of the trace ctx belongs to, or "" outside of one
+func traceID(ctx context.Context) string {
+	spanContext := trace.SpanContextFromContext(ctx)
+	if !spanContext.HasTraceID() {
+		return ""
+	}
+	return spanContext.TraceID().String()
+}
+
+// registerTracingCallbacks makes every gorm statement a child span of the span in its context.
+// Statements run without one, like the login guard's bookkeeping, are not traced
+func registerTracingCallbacks(db *gorm.DB) {
+	start := func(operation string) func(*gorm.DB) {
+		return func(tx *gorm.DB) {
+			if !trace.SpanContextFromContext(tx.Statement.Context).IsValid() {
+				return
+			}
+
+			_, span := tracer.Start(tx.Statement.Context, "gorm."+operation,
+				trace.WithSpanKind(trace.SpanKindClient),
+				trace.WithAttributes(attribute.String("db.system", "postgresql")))
+			tx.InstanceSet("tracing:span", span)
+		}
+	}
+
+	end := func(tx *gorm.DB) {
+		value, ok := tx.InstanceGet("tracing:span")
+		if !ok {
+			return
+		}
+		span := value.(trace.Span)
+		defer span.End()
+
+		span.SetAttributes(
+			attribute.String("db.statement", tx.Statement.SQL.String()),
+			attribute.String("db.sql.table", tx.Statement.Table),
+			attribute.Int64("db.rows_affected", tx.Statement.RowsAffected),
+		)
+		if tx.Error != nil && !errors.Is(tx.Error, gorm.ErrRecordNotFound) {
+			span.RecordError(tx.Error)
+			span.SetStatus(codes.Error, tx.Error.Error())
+		}
+	}
+
+	callbacks := db.Callback()
+	err := errors.Join(
+		callbacks.Create().Before("gorm:create").Register("tracing:create:start", start("create")),
+		callbacks.Create().After("gorm:create").Register("tracing:create", end),
+		callbacks.Query().Before("gorm:query").Register("tracing:query:start", start("query")),
+		callbacks.Query().After("gorm:query").Register("tracing:query", end),
+		callbacks.Update().Before("gorm:update").Register("tracing:update:start", start("update")),
+		callbacks.Update().After("gorm:update").Register("tracing:update", end),
+		callbacks.Delete().Before("gorm:delete").Register("tracing:delete:start", start("delete")),
+		callbacks.Delete().After("gorm:delete").Register("tracing:delete", end),
+		callbacks.Row().Before("gorm:row").Register("tracing:row:start", start("row")),
+		callbacks.Row().After("gorm:row").Register("tracing:row", end),
+		callbacks.Raw().Before("gorm:raw").Register("tracing:raw:start", start("raw")),
+		callbacks.Raw().After("gorm:raw").Register("tracing:raw", end),
+	)
+	if err != nil {
+		log.Fatalf("Failed to register database tracing callbacks: %v", err)
+	}
+}
@@ -1,23 +1,240 @@
 package main
 
 import (
-	"log"
+	"context"
+	"errors"
+	"gorm.io/gorm"
+	"log/slog"
+	"sync"
+	"time"
 )
 
-func GetAllUsers() []User {
+type UserFilter struct {
+	UsernamePrefix string
+}
+
+var userSorts = map[string]string{"username": "username", "name": "name"}
+
+// UserDirectory answers who is on the course. Game data never joins against it, so the course users
+// can live in another database than the players
+type UserDirectory interface {
+	// GetUser returns ErrUserNotFound for usernames that are not on the course
+	GetUser(ctx context.Context, username string) (User, error)
+	// FindUsers returns one page of course users matching the filter, the number of all matches and the cursor of the next page
+	FindUsers(ctx context.Context, filter UserFilter, page Page) ([]User, int64, string, error)
+}
+
+var Users UserDirectory
+
+// newUserDirectory builds the directory the configuration asks for. Courses using the bot read its users
+// through the synced roster when there is one
+func newUserDirectory(cfg UsersConfig) UserDirectory {
+	var bot UserDirectory = NewBotUserDirectory(UsersDB)
+	switch {
+	case cfg.SyncInterval > 0:
+		bot = NewRosterUserDirectory(GameDB)
+	case cfg.CacheTTL > 0:
+		bot = NewCachedUserDirectory(bot, cfg.CacheTTL)
+	}
+
+	return &CourseUserDirectory{
+		bot:    bot,
+		roster: NewRosterUserDirectory(GameDB),
+		open:   NewOpenUserDirectory(GameDB),
+	}
+}
+
+// CourseUserDirectory hands every call to the directory of the course of ctx
+type CourseUserDirectory struct {
+	bot, roster, open UserDirectory
+}
+
+func (d *CourseUserDirectory) pick(ctx context.Context) UserDirectory {
+	switch courseFrom(ctx).directory() {
+	case "roster":
+		return d.roster
+	case "open":
+		return d.open
+	}
+	return d.bot
+}
+
+func (d *CourseUserDirectory) FindUsers(ctx context.Context, filter UserFilter, page Page) ([]User, int64, string, error) {
+	return d.pick(ctx).FindUsers(ctx, filter, page)
+}
+
+func (d *CourseUserDirectory) GetUser(ctx context.Context, username string) (User, error) {
+	return d.pick(ctx).GetUser(ctx, username)
+}
+
+// allUsers pages through every user of the course of ctx
+func allUsers(ctx context.Context, directory UserDirectory) ([]User, error) {
+	page := Page{Limit: maxPageLimit, Sort: "username"}
+
+	var all []User
+	for {
+		users, _, next, err := directory.FindUsers(ctx, UserFilter{}, page)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, users...)
+
+		if next == "" {
+			return all, nil
+		}
+		if page.After, err = decodeCursor(next); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// BotUserDirectory reads the users table the Telegram bot owns
+type BotUserDirectory struct {
+	db *gorm.DB
+}
+
+func NewBotUserDirectory(db *gorm.DB) *BotUserDirectory {
+	return &BotUserDirectory{db: db}
+}
+
+func (d *BotUserDirectory) FindUsers(ctx context.Context, filter UserFilter, page Page) ([]User, int64, string, error) {
+	return findUsers(d.db.WithContext(ctx).Table("users"), filter, page)
+}
+
+func (d *BotUserDirectory) GetUser(ctx context.Context, username string) (User, error) {
+	return getUser(d.db.WithContext(ctx).Table("users"), username)
+}
+
+// AllUsers lists the whole course for the roster sync
+func (d *BotUserDirectory) AllUsers(ctx context.Context) ([]User, error) {
+	var users []User
+	err := d.db.WithContext(ctx).Table("users").Order("id").Find(&users).Error
+	return users, err
+}
+
+// OpenUserDirectory lets anyone register. The course is whoever did, so users are listed from the players
+type OpenUserDirectory struct {
+	db *gorm.DB
+}
+
+func NewOpenUserDirectory(db *gorm.DB) *OpenUserDirectory {
+	return &OpenUserDirectory{db: db}
+}
+
+func (d *OpenUserDirectory) players(ctx context.Context) *gorm.DB {
+	return d.db.WithContext(ctx).Table("(SELECT id, COALESCE(tg_id, 0) AS tg_id, login AS username, login AS name FROM players WHERE deleted_at IS NULL AND course_id = ?) AS users",
+		courseFrom(ctx).ID)
+}
+
+func (d *OpenUserDirectory) FindUsers(ctx context.Context, filter UserFilter, page Page) ([]User, int64, string, error) {
+	return findUsers(d.players(ctx), filter, page)
+}
+
+// GetUser knows every username, registered or not
+func (d *OpenUserDirectory) GetUser(ctx context.Context, username string) (User, error) {
+	user, err := getUser(d.players(ctx), username)
+	if errors.Is(err, ErrUserNotFound) {
+		return User{Username: username, Name: username}, nil
+	}
+	return user, err
+}
+
+// findUsers pages through a table with the columns of users
+func findUsers(query *gorm.DB, filter UserFilter, page Page) ([]User, int64, string, error) {
+	if filter.UsernamePrefix != "" {
+		query = query.Where("username LIKE ?", escapeLike(filter.UsernamePrefix)+"%")
+	}
+	query = query.Session(&gorm.Session{})
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		return nil, 0, "", err
+	}
+
+	var after interface{}
+	if page.After != nil {
+		value, err := decodeCursorValue[string](page.After.Value)
+		if err != nil {
+			return nil, 0, "", err
+		}
+		after = value
+	}
+
 	var users []User
-	result := BotDB.Table("users").Find(&users)
-	if result.Error != nil {
-		log.Fatal(result.Error)
+	if err := page.apply(query, after).Find(&users).Error; err != nil {
+		return nil, 0, "", err
+	}
+
+	if len(users) <= page.Limit {
+		return users, total, "", nil
 	}
-	return users
+
+	users = users[:page.Limit]
+	last := users[len(users)-1]
+
+	value := last.Username
+	if page.Sort == "name" {
+		value = last.Name
+	}
+
+	next, err := page.next(value, last.ID)
+	return users, total, next, err
 }
 
-func GetUserByUsername(username string) (User, error) {
+func getUser(query *gorm.DB, username string) (User, error) {
 	var user User
-	result := BotDB.Where("username = ?", username).First(&user)
-	if result.Error != nil {
-		return user, result.Error
+	result := query.Where("username = ?", username).First(&user)
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return user, ErrUserNotFound
+	}
+	return user, result.Error
+}
+
+// CachedUserDirectory remembers the users it looked up. Fresh entries save a round trip to the other
+// database, stale ones still answer while it is unreachable, so registration and exports keep working
+// through a bot database outage. Listing users is passed through and fails during one
+type CachedUserDirectory struct {
+	UserDirectory
+	ttl time.Duration
+
+	mu    sync.Mutex
+	users map[string]cachedUser
+}
+
+type cachedUser struct {
+	user      User
+	fetchedAt time.Time
+}
+
+func NewCachedUserDirectory(next UserDirectory, ttl time.Duration) *CachedUserDirectory {
+	return &CachedUserDirectory{UserDirectory: next, ttl: ttl, users: make(map[string]cachedUser)}
+}
+
+func (d *CachedUserDirectory) GetUser(ctx context.Context, username string) (User, error) {
+	d.mu.Lock()
+	cached, found := d.users[username]
+	d.mu.Unlock()
+
+	if found && time.Since(cached.fetchedAt) < d.ttl {
+		return cached.user, nil
+	}
+
+	user, err := d.UserDirectory.GetUser(ctx, username)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	switch {
+	case err == nil:
+		d.users[username] = cachedUser{user: user, fetchedAt: time.Now()}
+	case errors.Is(err, ErrUserNotFound):
+		delete(d.users, username)
+	case found && isUnavailable(err):
+		logger(ctx).Warn("users database is unreachable, answering from the cache",
+			slog.String("username", username),
+			slog.Duration("age", time.Since(cached.fetchedAt).Round(time.Second)),
+			slog.Any("error", err))
+		return cached.user, nil
 	}
-	return user, nil
+	return user, err
 }
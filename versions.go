@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// legacyDeprecatedAt is when the unversioned routes were superseded by /v1
+var legacyDeprecatedAt = time.Date(2026, time.October, 19, 0, 0, 0, 0, time.UTC)
+
+const defaultLegacySunset = "2027-02-01"
+
+// legacySunset is the day the unversioned routes go away, the legacy_sunset setting (YYYY-MM-DD) moves it
+func legacySunset(value string) time.Time {
+	sunset, err := time.Parse(time.DateOnly, value)
+	if err != nil {
+		log.Fatalf("Invalid LEGACY_SUNSET: %s", err)
+	}
+	return sunset
+}
+
+// Deprecated marks every response with the Deprecation (RFC 9745) and Sunset (RFC 8594) headers
+// and links the same route under /v1 of the same course
+func Deprecated(sunset time.Time) gin.HandlerFunc {
+	deprecation := fmt.Sprintf("@%d", legacyDeprecatedAt.Unix())
+	sunsetHeader := sunset.UTC().Format(http.TimeFormat)
+
+	return func(c *gin.Context) {
+		c.Header("Deprecation", deprecation)
+		c.Header("Sunset", sunsetHeader)
+		c.Writer.Header().Add("Link", fmt.Sprintf(`<%s>; rel="successor-version"`, successorPath(c)))
+
+		c.Next()
+	}
+}
+
+// successorPath puts /v1 right after the course prefix: /courses/x/players becomes /courses/x/v1/players
+func successorPath(c *gin.Context) string {
+	path := c.Request.URL.Path
+	prefix := ""
+	if slug := c.Param("course"); slug != "" {
+		prefix = "/courses/" + slug
+		path = strings.TrimPrefix(path, prefix)
+	}
+	return prefix + "/v1" + path
+}
+
+// routePrefix is what the router put in front of route for this request: the course prefix and
+// the version group, so /courses/x/v2/players with route /players gives /courses/x/v2
+func routePrefix(c *gin.Context, route string) string {
+	prefix := strings.TrimSuffix(c.FullPath(), route)
+	return strings.Replace(prefix, ":course", c.Param("course"), 1)
+}
+
+// BearerOnly makes authentication ignore the Authorization cookie. Without cookies there is
+// nothing a foreign site could ride on, so these routes need no CSRF token
+func BearerOnly() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Set("bearerOnly", true)
+		c.Next()
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// versionedRouter mounts route under the same prefixes newRouter uses and answers with the
+// successor link and the route prefix of the request
+func versionedRouter(route string) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+
+	handler := func(c *gin.Context) {
+		c.Header("X-Prefix", routePrefix(c, route))
+		c.Status(http.StatusNoContent)
+	}
+	for _, course := range []*gin.RouterGroup{router.Group("/"), router.Group("/courses/:course")} {
+		course.Group("/", Deprecated(time.Now())).GET(route, handler)
+		course.Group("/v1").GET(route, handler)
+		course.Group("/v2").GET(route, handler)
+	}
+	return router
+}
+
+func TestRoutePrefix(t *testing.T) {
+	router := versionedRouter("/players/:login/export")
+
+	tests := map[string]string{
+		"/players/alice/export":               "",
+		"/v1/players/alice/export":            "/v1",
+		"/v2/players/alice/export":            "/v2",
+		"/courses/os/players/alice/export":    "/courses/os",
+		"/courses/os/v1/players/alice/export": "/courses/os/v1",
+		"/courses/os/v2/players/alice/export": "/courses/os/v2",
+	}
+	for path, want := range tests {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if got := w.Header().Get("X-Prefix"); got != want {
+			t.Errorf("routePrefix for %s = %q, want %q", path, got, want)
+		}
+	}
+}
+
+func TestDeprecatedLinksSuccessorInCourse(t *testing.T) {
+	router := versionedRouter("/players")
+
+	tests := map[string]string{
+		"/players":            `</v1/players>; rel="successor-version"`,
+		"/courses/os/players": `</courses/os/v1/players>; rel="successor-version"`,
+	}
+	for path, want := range tests {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if got := w.Header().Get("Link"); got != want {
+			t.Errorf("Link for %s = %q, want %q", path, got, want)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/courses/os/v1/players", nil))
+	if got := w.Header().Get("Link"); got != "" {
+		t.Errorf("versioned route is linked to a successor: %q", got)
+	}
+}